@@ -0,0 +1,129 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// InconsistentDoc is a file document whose fields disagree on where the file is stored.
+// Fields names the fields that are inconsistent, ie. AmazonS3.path when the store is AmazonS3 but there is no path
+type InconsistentDoc struct {
+	FileID string
+	Store  string
+	Fields []string
+}
+
+// storeReferenceNames maps the store types to the sub document pointing at their object, the others are found by id
+var storeReferenceNames = map[string]string{
+	"AmazonS3":           "AmazonS3",
+	"GoogleCloudStorage": "GoogleStorage",
+	"AzureBlobStorage":   "AzureBlobStorage",
+	"WebDAV":             "WebDAV",
+	"SFTP":               "SFTP",
+}
+
+// AuditDocuments scans the completed files of the current store and returns the documents whose store, path, url
+// and store sub documents don't agree, ie. after a botched migration
+func (m *Migrate) AuditDocuments() ([]InconsistentDoc, error) {
+	return m.AuditDocumentsContext(context.Background())
+}
+
+// AuditDocumentsContext scans the documents like AuditDocuments
+func (m *Migrate) AuditDocumentsContext(ctx context.Context) ([]InconsistentDoc, error) {
+	if m.storeName == "" {
+		return nil, errors.New("no store Name")
+	}
+
+	cursor, err := m.findCursor(ctx, bson.M{"complete": true}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer cursor.Close(ctx)
+
+	var (
+		inconsistent []InconsistentDoc
+		scanned      int
+	)
+
+	for cursor.Next(ctx) {
+		var file rocketchat.File
+		if err := cursor.Decode(&file); err != nil {
+			return nil, err
+		}
+
+		scanned++
+
+		if fields := m.inconsistentFields(file); len(fields) > 0 {
+			inconsistent = append(inconsistent, InconsistentDoc{FileID: file.ID, Store: file.Store, Fields: fields})
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	m.infof("Audited %d documents of %s, %d are inconsistent", scanned, m.storeName, len(inconsistent))
+
+	return inconsistent, nil
+}
+
+// inconsistentFields returns the fields of the document that disagree with its store field
+func (m *Migrate) inconsistentFields(file rocketchat.File) []string {
+	var fields []string
+
+	storeType := file.Store
+	if i := strings.Index(file.Store, ":"); i >= 0 {
+		storeType = file.Store[:i]
+	}
+
+	if file.Store != storeType+":"+m.storeName {
+		fields = append(fields, "store")
+	}
+
+	keep := storeReferenceNames[storeType]
+	if keep != "" && storeReferencePath(storeType, file) == "" {
+		fields = append(fields, keep+".path")
+	}
+
+	// Sub documents of other stores make Rocket.Chat resolve the file in the wrong store
+	for _, reference := range storeReferences {
+		if reference != keep && referencePath(reference, file) != "" {
+			fields = append(fields, reference)
+		}
+	}
+
+	route := "/ufs/" + file.Store + "/" + file.ID + "/"
+
+	if !strings.Contains(file.Path, route) {
+		fields = append(fields, "path")
+	}
+
+	if !strings.Contains(file.URL, route) {
+		fields = append(fields, "url")
+	}
+
+	return fields
+}
+
+// referencePath returns the path of the named store sub document of the file
+func referencePath(reference string, file rocketchat.File) string {
+	switch reference {
+	case "AmazonS3":
+		return file.AmazonS3.Path
+	case "GoogleStorage":
+		return file.GoogleStorage.Path
+	case "AzureBlobStorage":
+		return file.AzureBlobStorage.Path
+	case "WebDAV":
+		return file.WebDAV.Path
+	case "SFTP":
+		return file.SFTP.Path
+	}
+
+	return ""
+}
@@ -0,0 +1,42 @@
+package migrator
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"github.com/RocketChat/filestore-migrator/store"
+)
+
+func TestFixedDocumentsAreConsistent(t *testing.T) {
+	names := []string{"report.pdf", "quarterly report.pdf", "issue #42.png", "what?.txt", "100%.txt", "ünïcödé ✓.md"}
+
+	destinations := []store.Provider{&store.FileSystemStorageProvider{}, &store.GridFSProvider{}, &store.S3Provider{}, &store.SFTPProvider{}}
+
+	for _, destination := range destinations {
+		for _, name := range names {
+			t.Run(destination.StoreType()+"/"+name, func(t *testing.T) {
+				m := &Migrate{storeName: "Uploads", uniqueID: "unique-id", fileCollectionName: "rocketchat_uploads", destinationStore: destination}
+
+				file := rocketchat.File{ID: "file-id", Name: name, Rid: "room-id", UserID: "user-id", Store: "GoogleCloudStorage:Uploads"}
+				file.GoogleStorage.Path = "old/path"
+
+				objectPath, err := m.getObjectPath(&file)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				m.fixFileForUpload(&file, objectPath)
+
+				if fields := m.inconsistentFields(file); len(fields) > 0 {
+					t.Errorf("inconsistentFields() = %v for path %q, want none", fields, file.Path)
+				}
+
+				// Spaces and # would cut the route short when Rocket.Chat parses it as a URL
+				if strings.ContainsAny(file.Path, " #?") {
+					t.Errorf("Path = %q, want the file name escaped", file.Path)
+				}
+			})
+		}
+	}
+}
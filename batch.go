@@ -0,0 +1,158 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// pendingUpdate is a file whose document still has to be pointed at the destination store
+type pendingUpdate struct {
+	file   rocketchat.File
+	update bson.M
+	index  int
+	total  int
+
+	// sourceFile is removed from the source store and tempFile from disk once the document is updated
+	sourceFile *rocketchat.File
+	tempFile   string
+}
+
+// updateBatch holds the updates waiting to be written together
+type updateBatch struct {
+	mu      sync.Mutex
+	pending []pendingUpdate
+}
+
+// SetUpdateBatchSize sets how many document updates are written to the database at once.
+// A file only counts as completed when its batch is written, the last partial batch is written when the run ends
+func (m *Migrate) SetUpdateBatchSize(n int) error {
+	if n < 1 {
+		return errors.New("update batch size must be at least 1")
+	}
+
+	m.updateBatchSize = n
+
+	return nil
+}
+
+// updateFile points the file document at the destination store, right away or as part of a batch
+func (m *Migrate) updateFile(ctx context.Context, p pendingUpdate) error {
+	m.progress(p.file, p.index, p.total, PhaseUpdating, nil)
+
+	if m.updateBatchSize <= 1 {
+		collection := m.session.Client().Database(m.databaseName).Collection(m.fileCollectionName)
+
+		if err := m.withDatabaseRetry(ctx, "Update of "+p.file.Name, func() error {
+			_, err := collection.UpdateOne(ctx, bson.M{"_id": p.file.ID}, p.update)
+			return err
+		}); err != nil {
+			m.progress(p.file, p.index, p.total, PhaseUpdating, err)
+			return err
+		}
+
+		m.finishUpdate(p)
+
+		return nil
+	}
+
+	var batch []pendingUpdate
+
+	m.updates.mu.Lock()
+	m.updates.pending = append(m.updates.pending, p)
+	if len(m.updates.pending) >= m.updateBatchSize {
+		batch = m.updates.pending
+		m.updates.pending = nil
+	}
+	m.updates.mu.Unlock()
+
+	if batch == nil {
+		return nil
+	}
+
+	return m.writeUpdates(ctx, batch)
+}
+
+// flushUpdates writes the updates still waiting in the batch
+func (m *Migrate) flushUpdates(ctx context.Context) error {
+	m.updates.mu.Lock()
+	batch := m.updates.pending
+	m.updates.pending = nil
+	m.updates.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	return m.writeUpdates(ctx, batch)
+}
+
+func (m *Migrate) writeUpdates(ctx context.Context, batch []pendingUpdate) error {
+	models := make([]mongo.WriteModel, 0, len(batch))
+	for _, p := range batch {
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": p.file.ID}).SetUpdate(p.update))
+	}
+
+	m.debugf("Writing %v document updates", len(batch))
+
+	collection := m.session.Client().Database(m.databaseName).Collection(m.fileCollectionName)
+
+	// The updates only set and unset fields, so writing the whole batch again is harmless
+	err := m.withDatabaseRetry(ctx, fmt.Sprintf("Write of %v document updates", len(batch)), func() error {
+		_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		return err
+	})
+
+	failed := make(map[int]error)
+
+	if err != nil {
+		var bulkErr mongo.BulkWriteException
+		if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+			for _, writeErr := range bulkErr.WriteErrors {
+				failed[writeErr.Index] = writeErr
+			}
+		} else {
+			for i := range batch {
+				failed[i] = err
+			}
+		}
+	}
+
+	for i, p := range batch {
+		if updateErr, ok := failed[i]; ok {
+			m.progress(p.file, p.index, p.total, PhaseUpdating, updateErr)
+			continue
+		}
+
+		m.finishUpdate(p)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d document updates failed: %w", len(failed), len(batch), err)
+	}
+
+	return nil
+}
+
+// finishUpdate runs what has to wait for the document update and marks the file completed
+func (m *Migrate) finishUpdate(p pendingUpdate) {
+	if p.sourceFile != nil {
+		m.deleteSourceFile(p.index, p.total, *p.sourceFile)
+	}
+
+	if p.tempFile != "" {
+		if err := os.Remove(p.tempFile); err != nil && !os.IsNotExist(err) {
+			m.errorf("[%v/%v] Failed to remove temp file %s: %v", p.index, p.total, p.tempFile, err)
+		}
+	}
+
+	m.debugf("[%v/%v] Completed Uploading %s", p.index, p.total, p.file.Name)
+	m.progress(p.file, p.index, p.total, PhaseCompleted, nil)
+}
@@ -0,0 +1,146 @@
+package migrator
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+)
+
+// checkpointFlushEvery is how many completed files are buffered before the checkpoint is written to disk
+const checkpointFlushEvery = 50
+
+// checkpoint records the ids of completed files, one per line, so an interrupted run can be resumed
+type checkpoint struct {
+	mu      sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	pending int
+}
+
+// SetCheckpointFile sets a file where the ids of completed files are appended.
+// Files listed in it are left out of following runs, making interrupted migrations resumable
+func (m *Migrate) SetCheckpointFile(path string) {
+	m.checkpointFile = path
+}
+
+// loadCheckpoint reads the ids of completed files, a missing checkpoint file means nothing was completed yet
+func loadCheckpoint(path string) (map[string]struct{}, error) {
+	completed := make(map[string]struct{})
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return completed, nil
+		}
+
+		return nil, err
+	}
+
+	lines := strings.Split(string(content), "\n")
+
+	// The last entry is either empty or a line cut short by a crash, neither are complete ids
+	for _, id := range lines[:len(lines)-1] {
+		if id != "" {
+			completed[id] = struct{}{}
+		}
+	}
+
+	return completed, nil
+}
+
+// filterCheckpointed leaves out the files already listed in the checkpoint file
+func (m *Migrate) filterCheckpointed(files []rocketchat.File) ([]rocketchat.File, error) {
+	if m.checkpointFile == "" {
+		return files, nil
+	}
+
+	completed, err := loadCheckpoint(m.checkpointFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(completed) == 0 {
+		return files, nil
+	}
+
+	remaining := files[:0]
+
+	for _, file := range files {
+		if _, ok := completed[file.ID]; !ok {
+			remaining = append(remaining, file)
+		}
+	}
+
+	m.debugf("Skipping %v files already listed in checkpoint %s", len(files)-len(remaining), m.checkpointFile)
+
+	return remaining, nil
+}
+
+// openCheckpoint starts recording completed files for the current run, the returned func flushes and closes it
+func (m *Migrate) openCheckpoint() (func(), error) {
+	if m.checkpointFile == "" {
+		return func() {}, nil
+	}
+
+	f, err := os.OpenFile(m.checkpointFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	m.checkpoint = &checkpoint{
+		file:   f,
+		writer: bufio.NewWriter(f),
+	}
+
+	return func() {
+		if err := m.checkpoint.close(); err != nil {
+			m.errorf("unable to write checkpoint: %v", err)
+		}
+
+		m.checkpoint = nil
+	}, nil
+}
+
+func (c *checkpoint) add(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.writer.WriteString(id + "\n"); err != nil {
+		return err
+	}
+
+	c.pending++
+
+	if c.pending < checkpointFlushEvery {
+		return nil
+	}
+
+	c.pending = 0
+
+	return c.flush()
+}
+
+// flush writes the buffered ids and syncs them so they survive a crash, callers must hold mu
+func (c *checkpoint) flush() error {
+	if err := c.writer.Flush(); err != nil {
+		return err
+	}
+
+	return c.file.Sync()
+}
+
+func (c *checkpoint) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.flush(); err != nil {
+		c.file.Close()
+		return err
+	}
+
+	return c.file.Close()
+}
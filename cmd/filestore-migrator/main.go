@@ -1,8 +1,13 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	pkg "github.com/RocketChat/filestore-migrator"
 )
@@ -12,15 +17,24 @@ func main() {
 	databaseURL := flag.String("databaseUrl", "", "Rocket.Chat database connection string")
 	detectSource := flag.Bool("detectSource", true, "Autodetect the source target using the Rocket.Chat configuration")
 	detectDestination := flag.Bool("detectDestination", false, "Autodetect the destionation using the Rocket.Chat configuration")
-	sourceType := flag.String("sourceType", "s3", "Source storage provider (s3, google, gridfs, filesystem)")
+	sourceType := flag.String("sourceType", "s3", "Source storage provider (s3, google, azure, webdav, gridfs, filesystem)")
 	sourceURL := flag.String("sourceUrl", "", "Source connection string")
-	destinationType := flag.String("destinationType", "s3", "Destination storage provider (s3, google, fs)")
+	destinationType := flag.String("destinationType", "s3", "Destination storage provider (s3, google, azure, webdav, gridfs, fs)")
 	destinationURL := flag.String("destinationUrl", "", "Destination connection string")
 	tempLocation := flag.String("tempLocation", "/tmp/filestore-migrator", "Temporary file location")
-	store := flag.String("store", "Uploads", "Name of the storage to be used in the operation")
-	action := flag.String("action", "download", "Type of action to me performed by the tool (migrate, upload, download )")
+	store := flag.String("store", "Uploads", "Name of the storage to be used in the operation (Uploads, Avatars, UserDataFiles)")
+	action := flag.String("action", "download", "Type of action to me performed by the tool (migrate, migrateAll, sync, upload, download, repoint, purgeOrphans, preflight, audit, revert)")
 	skipErrors := flag.Bool("skipErrors", false, "Skip on error")
 	verbose := flag.Bool("verbose", true, "Enable verbose logs")
+	dryRun := flag.Bool("dryRun", false, "Log the planned actions without uploading files or updating the database")
+	avatarKey := flag.String("avatarKey", "userId", "Field avatar objects are keyed by (userId, username)")
+	offsetStore := flag.String("offsetStore", "", "JSON file keeping the upload date of the newest migrated file, following runs start from it")
+	allowSameStore := flag.Bool("allowSameStore", false, "Allow migrating between a source and destination that are the same store")
+	presignedDownloads := flag.Bool("presignedDownloads", false, "Read files from presigned URLs of the source store when it supports them (s3)")
+	preserveOriginalStore := flag.Bool("preserveOriginalStore", false, "Keep the store, path and url of migrated files in previous fields so the migration can be reverted")
+	updateDatabase := flag.Bool("updateDatabase", true, "Point the file documents at the destination, disable to only copy the files")
+	uniqueID := flag.String("uniqueID", "", "uniqueID to build object paths with, for instances without the uniqueID setting")
+	sourceLayout := flag.String("sourceLayout", "id", "Layout of the files to upload (id for <tempLocation>/<store>/<id>, ufs for a Rocket.Chat FileSystem store)")
 
 	flag.Parse()
 
@@ -53,6 +67,53 @@ func main() {
 		panic(err)
 	}
 
+	defer migrate.Close()
+
+	// The first signal lets the files in flight finish, a second one exits right away
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		log.Println("Shutting down, waiting for the files in flight. Signal again to exit immediately")
+		migrate.Shutdown()
+
+		<-signals
+		os.Exit(1)
+	}()
+
+	migrate.SetDryRun(*dryRun)
+	migrate.SetUpdateDatabase(*updateDatabase)
+	migrate.SetAllowSameStore(*allowSameStore)
+	migrate.SetPresignedDownloads(*presignedDownloads)
+	migrate.SetPreserveOriginalStore(*preserveOriginalStore)
+
+	if *offsetStore != "" {
+		migrate.SetOffsetStore(*offsetStore)
+	}
+
+	if *uniqueID != "" {
+		migrate.SetUniqueID(*uniqueID)
+	}
+
+	switch *avatarKey {
+	case "userId":
+		migrate.SetAvatarKey(pkg.AvatarKeyUserID)
+	case "username":
+		migrate.SetAvatarKey(pkg.AvatarKeyUsername)
+	default:
+		panic("avatarKey must be userId or username")
+	}
+
+	switch *sourceLayout {
+	case "id":
+		migrate.SetSourceLayout(pkg.SourceLayoutByID)
+	case "ufs":
+		migrate.SetSourceLayout(pkg.SourceLayoutUFS)
+	default:
+		panic("sourceLayout must be id or ufs")
+	}
+
 	if err := migrate.SetStoreName(*store); err != nil {
 		panic(err)
 	}
@@ -60,23 +121,57 @@ func main() {
 	switch *action {
 	case "migrate":
 		log.Println("Beginning migration of files")
-		if err := migrate.MigrateStore(); err != nil {
-			panic(err)
+		err = migrate.MigrateStore()
+	case "migrateAll":
+		log.Println("Beginning migration of files of all stores")
+		_, err = migrate.MigrateAllStores()
+	case "sync":
+		if *offsetStore == "" {
+			panic("When specifying sync action you need to provide the offsetStore")
 		}
+
+		log.Println("Beginning sync of new files")
+		_, err = migrate.SyncNew()
 	case "upload":
 		log.Println("Beginning upload of files")
-		if err := migrate.UploadAll(config.TempFileLocation); err != nil {
-			panic(err)
-		}
+		err = migrate.UploadAll(config.TempFileLocation)
 	case "download":
 		log.Println("Beginning download of files")
-		if err := migrate.DownloadAll(); err != nil {
-			panic(err)
+		err = migrate.DownloadAll()
+	case "repoint":
+		log.Println("Beginning repointing of files already in the destination")
+		err = migrate.RepointStore()
+	case "purgeOrphans":
+		log.Println("Beginning removal of orphaned files from the source")
+		_, err = migrate.PurgeOrphans(*dryRun)
+	case "preflight":
+		log.Println("Checking the database, source and destination")
+		err = migrate.Preflight()
+	case "audit":
+		log.Println("Beginning audit of the file documents")
+
+		var inconsistent []pkg.InconsistentDoc
+		inconsistent, err = migrate.AuditDocuments()
+
+		for _, doc := range inconsistent {
+			log.Printf("%s (%s): %s", doc.FileID, doc.Store, strings.Join(doc.Fields, ", "))
 		}
+	case "revert":
+		log.Println("Beginning revert of files to their previous store")
+		err = migrate.RevertStore()
 	default:
 		flag.Usage()
 		return
 	}
 
+	if errors.Is(err, pkg.ErrShutdown) {
+		log.Println("Stopped before all files were processed")
+		return
+	}
+
+	if err != nil {
+		panic(err)
+	}
+
 	log.Println("Finished!")
 }
@@ -32,11 +32,6 @@ func parseDatabase(url string) (*config.DatabaseConfig, error) {
 
 func parseTarget(name string, typ string, connstr string, action string) (*config.MigrateTarget, error) {
 	if typ != "" {
-		if name == "destination" && typ == "gridfs" {
-			err := errors.New("You cannot use gridfs as a destination target")
-			return nil, err
-		}
-
 		switch typ {
 		case "gridfs":
 			target := config.MigrateTarget{
@@ -94,13 +89,21 @@ func parseTarget(name string, typ string, connstr string, action string) (*confi
 			if err != nil {
 				panic(err)
 			}
+			forcePathStyle := false
+			if urlInfo.Query().Get("forcePathStyle") != "" {
+				forcePathStyle, err = strconv.ParseBool(urlInfo.Query().Get("forcePathStyle"))
+				if err != nil {
+					panic(err)
+				}
+			}
 			target.AmazonS3 = config.MigrateTargetS3{
-				Endpoint:  endpoint,
-				Bucket:    bucket,
-				AccessID:  accessID,
-				AccessKey: accessKey,
-				Region:    region,
-				UseSSL:    ssl,
+				Endpoint:       endpoint,
+				Bucket:         bucket,
+				AccessID:       accessID,
+				AccessKey:      accessKey,
+				Region:         region,
+				UseSSL:         ssl,
+				ForcePathStyle: forcePathStyle,
 			}
 
 			return &target, nil
@@ -139,6 +142,80 @@ func parseTarget(name string, typ string, connstr string, action string) (*confi
 				Bucket:  bucket,
 			}
 
+			return &target, nil
+		case "azure":
+			target := config.MigrateTarget{
+				Type: "AzureBlobStorage",
+			}
+
+			if name == "source" && action == "upload" {
+				target.ReferenceOnly = true
+				return &target, nil
+			}
+
+			if connstr == "" {
+				return nil, fmt.Errorf("The %s target information is incomplete", name)
+			}
+
+			urlInfo, err := url.Parse(connstr)
+			if err != nil {
+				panic(err)
+			}
+			if urlInfo.Host == "" {
+				err := errors.New("The informed Azure connection string doesn't contain the endpoint field")
+				return nil, err
+			}
+			container := strings.Trim(urlInfo.EscapedPath(), "/")
+			if container == "" {
+				err := errors.New("The informed Azure connection string doesn't contain the container field")
+				return nil, err
+			}
+			accountKey := urlInfo.Query().Get("accountKey")
+			if accountKey == "" {
+				err := errors.New("The informed Azure connection string doesn't contain the account key field")
+				return nil, err
+			}
+
+			target.AzureBlobStorage = config.MigrateTargetAzureBlob{
+				AccountName: strings.Split(urlInfo.Host, ".")[0],
+				AccountKey:  accountKey,
+				Endpoint:    urlInfo.Scheme + "://" + urlInfo.Host,
+				Container:   container,
+			}
+
+			return &target, nil
+		case "webdav":
+			target := config.MigrateTarget{
+				Type: "WebDAV",
+			}
+
+			if name == "source" && action == "upload" {
+				target.ReferenceOnly = true
+				return &target, nil
+			}
+
+			if connstr == "" {
+				return nil, fmt.Errorf("The %s target information is incomplete", name)
+			}
+
+			urlInfo, err := url.Parse(connstr)
+			if err != nil {
+				panic(err)
+			}
+			if urlInfo.Host == "" {
+				err := errors.New("The informed WebDAV connection string doesn't contain the server field")
+				return nil, err
+			}
+
+			password, _ := urlInfo.User.Password()
+			target.WebDAV = config.MigrateTargetWebDAV{
+				Username: urlInfo.User.Username(),
+				Password: password,
+			}
+
+			urlInfo.User = nil
+			target.WebDAV.URL = urlInfo.String()
+
 			return &target, nil
 		case "filesystem":
 			fallthrough
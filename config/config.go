@@ -11,45 +11,116 @@ var _config *Config
 
 // Config is the configuration object that will be deserialized from yaml and passed into the migrate client
 type Config struct {
-	Database         DatabaseConfig `yaml:"database"`
-	Source           MigrateTarget  `yaml:"source"`
-	Destination      MigrateTarget  `yaml:"destination"`
-	TempFileLocation string         `yaml:"tempFileLocation"`
-	DebugMode        bool           `yaml:"debugMode"`
-	FileDelay        string         `yaml:"fileDelay"`
+	Database            DatabaseConfig `yaml:"database"`
+	Source              MigrateTarget  `yaml:"source"`
+	Destination         MigrateTarget  `yaml:"destination"`
+	TempFileLocation    string         `yaml:"tempFileLocation"`
+	DebugMode           bool           `yaml:"debugMode"`
+	FileDelay           string         `yaml:"fileDelay"`
+	FileDelayJitter     float64        `yaml:"fileDelayJitter"`
+	SkipErrors          bool           `yaml:"skipErrors"`
+	MaxConcurrency      int            `yaml:"maxConcurrency"`
+	DownloadConcurrency int            `yaml:"downloadConcurrency"`
+	UploadConcurrency   int            `yaml:"uploadConcurrency"`
+	CursorBatchSize     int            `yaml:"cursorBatchSize"`
 }
 
 // DatabaseConfig configuration to connect to database
 type DatabaseConfig struct {
-	ConnectionString string `yaml:"connectionString"`
-	Database         string `yaml:"database"`
+	ConnectionString   string            `yaml:"connectionString"`
+	Database           string            `yaml:"database"`
+	SettingsCollection string            `yaml:"settingsCollection"`
+	TLS                DatabaseTLSConfig `yaml:"tls"`
+}
+
+// DatabaseTLSConfig configures TLS to the database with certificates from files, setting any of it enables TLS
+type DatabaseTLSConfig struct {
+	CAFile             string `yaml:"caFile"`
+	CertFile           string `yaml:"certFile"`
+	KeyFile            string `yaml:"keyFile"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
 }
 
 // MigrateTarget is a FileStore configuration for either source or destination
 type MigrateTarget struct {
-	Type          string                     `yaml:"type"`
-	ReferenceOnly bool                       `yaml:"-"`
-	GoogleStorage MigrateTargetGoogleStorage `yaml:"GoogleStorage"`
-	AmazonS3      MigrateTargetS3            `yaml:"AmazonS3"`
-	FileSystem    MigrateTargetFileSystem    `yaml:"FileSystem"`
+	Type             string                     `yaml:"type"`
+	ReferenceOnly    bool                       `yaml:"-" json:"-"`
+	GoogleStorage    MigrateTargetGoogleStorage `yaml:"GoogleStorage"`
+	AmazonS3         MigrateTargetS3            `yaml:"AmazonS3"`
+	FileSystem       MigrateTargetFileSystem    `yaml:"FileSystem"`
+	AzureBlobStorage MigrateTargetAzureBlob     `yaml:"AzureBlobStorage"`
+	WebDAV           MigrateTargetWebDAV        `yaml:"WebDAV"`
+	SFTP             MigrateTargetSFTP          `yaml:"SFTP"`
+	GridFS           MigrateTargetGridFS        `yaml:"GridFS"`
 }
 
 type MigrateTargetGoogleStorage struct {
 	JSONKey string `yaml:"jsonKey"`
-	Bucket  string `yaml:"bucket"`
+	// JSONKeyFile is the path of a service account key, used when jsonKey isn't set.
+	// Without either the application default credentials are used
+	JSONKeyFile string `yaml:"jsonKeyFile"`
+	Bucket      string `yaml:"bucket"`
+	// ChunkSize in bytes of resumable uploads, larger files are uploaded in chunks of this size. Defaults to 8 MiB
+	ChunkSize int `yaml:"chunkSize"`
 }
 
 type MigrateTargetS3 struct {
-	Endpoint  string `yaml:"endpoint"`
-	Bucket    string `yaml:"bucket"`
-	AccessID  string `yaml:"accessId"`
-	AccessKey string `yaml:"accessKey"`
-	Region    string `yaml:"region"`
-	UseSSL    bool   `yaml:"useSSL"`
+	Endpoint       string `yaml:"endpoint"`
+	Bucket         string `yaml:"bucket"`
+	AccessID       string `yaml:"accessId"`
+	AccessKey      string `yaml:"accessKey"`
+	Region         string `yaml:"region"`
+	UseSSL         bool   `yaml:"useSSL"`
+	ForcePathStyle bool   `yaml:"forcePathStyle"`
+	// ServerSideEncryption is applied to uploaded objects, either AES256 (SSE-S3) or aws:kms (SSE-KMS)
+	ServerSideEncryption string `yaml:"serverSideEncryption"`
+	KMSKeyID             string `yaml:"kmsKeyId"`
+	// StorageClass of uploaded objects, ie. STANDARD_IA or INTELLIGENT_TIERING. Defaults to STANDARD
+	StorageClass string `yaml:"storageClass"`
+	// PartSize in bytes and UploadConcurrency tune the multipart uploads of large files
+	PartSize          uint64 `yaml:"partSize"`
+	UploadConcurrency uint   `yaml:"uploadConcurrency"`
+	// TagObjects tags uploaded objects with the rid, userId and store of their file
+	TagObjects bool `yaml:"tagObjects"`
 }
 
 type MigrateTargetFileSystem struct {
 	Location string `yaml:"location"`
+	Compress bool   `yaml:"compress"`
+}
+
+type MigrateTargetAzureBlob struct {
+	AccountName      string `yaml:"accountName"`
+	AccountKey       string `yaml:"accountKey"`
+	ConnectionString string `yaml:"connectionString"`
+	Endpoint         string `yaml:"endpoint"`
+	Container        string `yaml:"container"`
+}
+
+type MigrateTargetWebDAV struct {
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type MigrateTargetGridFS struct {
+	// Buckets maps file collections to the GridFS bucket their files are in, when it isn't named after the collection
+	Buckets map[string]string `yaml:"buckets"`
+	// ChunkSize in bytes of uploaded files, the driver default of 255 KiB is used when not set
+	ChunkSize int32 `yaml:"chunkSize"`
+}
+
+type MigrateTargetSFTP struct {
+	Host                  string `yaml:"host"`
+	Port                  int    `yaml:"port"`
+	Username              string `yaml:"username"`
+	Password              string `yaml:"password"`
+	PrivateKey            string `yaml:"privateKey"`
+	PrivateKeyFile        string `yaml:"privateKeyFile"`
+	PrivateKeyPassphrase  string `yaml:"privateKeyPassphrase"`
+	KnownHostsFile        string `yaml:"knownHostsFile"`
+	InsecureIgnoreHostKey bool   `yaml:"insecureIgnoreHostKey"`
+	Location              string `yaml:"location"`
 }
 
 // Get returns the config
@@ -66,7 +137,7 @@ func (c *Config) Load(filePath string) error {
 	}
 
 	if err := yaml.Unmarshal(yamlFile, c); err != nil {
-		log.Fatalf("Unmarshal: %v", err)
+		log.Printf("Unmarshal: %v", err)
 		return err
 	}
 
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// LoadConfig reads a configuration from a .yaml, .yml or .json file. References like ${AWS_SECRET} in string values
+// are replaced with the value of the environment variable, and keys that aren't part of the configuration are an error
+func LoadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(Config)
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+
+		if err := decoder.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config file %s, expected .yaml, .yml or .json", path)
+	}
+
+	if err := interpolateEnv(cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// interpolateEnv replaces ${NAME} in the string values of cfg with the environment variable NAME. It runs on the
+// decoded values, so values never need escaping for the file format and references in comments are left alone
+func interpolateEnv(cfg *Config) error {
+	var missing []string
+
+	expandStrings(reflect.ValueOf(cfg).Elem(), func(s string) string {
+		return envReference.ReplaceAllStringFunc(s, func(reference string) string {
+			name := envReference.FindStringSubmatch(reference)[1]
+
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+				return reference
+			}
+
+			return value
+		})
+	})
+
+	if len(missing) > 0 {
+		return fmt.Errorf("environment variables referenced in config are not set: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// expandStrings runs expand on every string reachable from v, v has to be settable
+func expandStrings(v reflect.Value, expand func(string) string) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(expand(v.String()))
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				expandStrings(v.Field(i), expand)
+			}
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			expandStrings(v.Elem(), expand)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			expandStrings(v.Index(i), expand)
+		}
+	case reflect.Map:
+		// Map values can't be set in place, they are expanded on a copy that is stored back
+		for _, key := range v.MapKeys() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+
+			expandStrings(value, expand)
+			v.SetMapIndex(key, value)
+		}
+	}
+}
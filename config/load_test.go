@@ -0,0 +1,92 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes content to a file named name in a temporary directory and returns its path
+func writeConfig(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func setEnv(t *testing.T, name string, value string) {
+	previous, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func TestLoadConfigInterpolatesEnv(t *testing.T) {
+	// Characters that are special in YAML or JSON must end up in the value unchanged
+	secret := `p@ss: "word" # not a comment \ {}`
+	setEnv(t, "FILESTORE_TEST_SECRET", secret)
+	setEnv(t, "FILESTORE_TEST_BUCKET", "uploads")
+
+	files := map[string]string{
+		"config.yaml": `
+# ${FILESTORE_TEST_UNSET} in a comment is left alone
+destination:
+  type: AmazonS3
+  AmazonS3:
+    bucket: files-${FILESTORE_TEST_BUCKET}
+    accessKey: ${FILESTORE_TEST_SECRET}
+  GridFS:
+    buckets:
+      rocketchat_uploads: ${FILESTORE_TEST_BUCKET}
+`,
+		"config.json": `{
+  "destination": {
+    "type": "AmazonS3",
+    "AmazonS3": {"bucket": "files-${FILESTORE_TEST_BUCKET}", "accessKey": "${FILESTORE_TEST_SECRET}"},
+    "GridFS": {"buckets": {"rocketchat_uploads": "${FILESTORE_TEST_BUCKET}"}}
+  }
+}`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfig(t, name, content))
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+
+			if cfg.Destination.AmazonS3.AccessKey != secret {
+				t.Errorf("accessKey = %q, want %q", cfg.Destination.AmazonS3.AccessKey, secret)
+			}
+
+			if cfg.Destination.AmazonS3.Bucket != "files-uploads" {
+				t.Errorf("bucket = %q, want files-uploads", cfg.Destination.AmazonS3.Bucket)
+			}
+
+			if bucket := cfg.Destination.GridFS.Buckets["rocketchat_uploads"]; bucket != "uploads" {
+				t.Errorf("GridFS bucket = %q, want uploads", bucket)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMissingEnv(t *testing.T) {
+	os.Unsetenv("FILESTORE_TEST_UNSET")
+
+	path := writeConfig(t, "config.yaml", "destination:\n  AmazonS3:\n    accessKey: ${FILESTORE_TEST_UNSET}\n")
+
+	_, err := LoadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "FILESTORE_TEST_UNSET") {
+		t.Errorf("LoadConfig() error = %v, want it to name FILESTORE_TEST_UNSET", err)
+	}
+}
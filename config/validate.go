@@ -0,0 +1,145 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// minS3PartSize is the smallest part S3 accepts in a multipart upload
+const minS3PartSize = 5 << 20
+
+type requiredField struct {
+	name  string
+	value string
+}
+
+// Validate checks that everything needed to reach the database and the stores is set.
+// The error names the first missing field as it is written in the yaml configuration
+func (c *Config) Validate() error {
+	if err := require("database",
+		requiredField{"connectionString", c.Database.ConnectionString},
+		requiredField{"database", c.Database.Database},
+	); err != nil {
+		return err
+	}
+
+	if c.MaxConcurrency < 0 {
+		return errors.New("maxConcurrency can't be negative")
+	}
+
+	if c.DownloadConcurrency < 0 {
+		return errors.New("downloadConcurrency can't be negative")
+	}
+
+	if c.UploadConcurrency < 0 {
+		return errors.New("uploadConcurrency can't be negative")
+	}
+
+	if c.CursorBatchSize < 0 {
+		return errors.New("cursorBatchSize can't be negative")
+	}
+
+	if c.FileDelayJitter < 0 || c.FileDelayJitter > 1 {
+		return errors.New("fileDelayJitter must be between 0 and 1")
+	}
+
+	if c.Source.Type == "" && c.Destination.Type == "" {
+		return errors.New("source.type or destination.type is required")
+	}
+
+	// Stores detected from Rocket.Chat's settings are only used to read the file references
+	if c.Source.Type != "" && !c.Source.ReferenceOnly {
+		if err := c.Source.validate("source"); err != nil {
+			return err
+		}
+	}
+
+	if c.Destination.Type != "" {
+		if err := c.Destination.validate("destination"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *MigrateTarget) validate(prefix string) error {
+	switch t.Type {
+	case "GridFS":
+		if t.GridFS.ChunkSize < 0 {
+			return fmt.Errorf("%s.GridFS.chunkSize must not be negative", prefix)
+		}
+
+		for collection, bucket := range t.GridFS.Buckets {
+			if bucket == "" {
+				return fmt.Errorf("%s.GridFS.buckets.%s is empty", prefix, collection)
+			}
+		}
+
+		return nil
+	case "GoogleStorage":
+		if t.GoogleStorage.ChunkSize < 0 {
+			return fmt.Errorf("%s.GoogleStorage.chunkSize must not be negative", prefix)
+		}
+
+		return require(prefix+".GoogleStorage", requiredField{"bucket", t.GoogleStorage.Bucket})
+	case "AmazonS3":
+		switch t.AmazonS3.ServerSideEncryption {
+		case "", "AES256", "aws:kms":
+		default:
+			return fmt.Errorf("%s.AmazonS3.serverSideEncryption %q is not supported, use AES256 or aws:kms", prefix, t.AmazonS3.ServerSideEncryption)
+		}
+
+		if t.AmazonS3.PartSize != 0 && t.AmazonS3.PartSize < minS3PartSize {
+			return fmt.Errorf("%s.AmazonS3.partSize must be at least %d bytes", prefix, minS3PartSize)
+		}
+
+		return require(prefix+".AmazonS3",
+			requiredField{"bucket", t.AmazonS3.Bucket},
+			requiredField{"accessId", t.AmazonS3.AccessID},
+			requiredField{"accessKey", t.AmazonS3.AccessKey},
+		)
+	case "AzureBlobStorage":
+		if err := require(prefix+".AzureBlobStorage", requiredField{"container", t.AzureBlobStorage.Container}); err != nil {
+			return err
+		}
+
+		if t.AzureBlobStorage.ConnectionString != "" {
+			return nil
+		}
+
+		return require(prefix+".AzureBlobStorage",
+			requiredField{"accountName", t.AzureBlobStorage.AccountName},
+			requiredField{"accountKey", t.AzureBlobStorage.AccountKey},
+		)
+	case "FileSystem":
+		return require(prefix+".FileSystem", requiredField{"location", t.FileSystem.Location})
+	case "WebDAV":
+		return require(prefix+".WebDAV", requiredField{"url", t.WebDAV.URL})
+	case "SFTP":
+		if t.SFTP.Password == "" && t.SFTP.PrivateKey == "" && t.SFTP.PrivateKeyFile == "" {
+			return fmt.Errorf("%s.SFTP.password, privateKey or privateKeyFile is required", prefix)
+		}
+
+		if t.SFTP.KnownHostsFile == "" && !t.SFTP.InsecureIgnoreHostKey {
+			return fmt.Errorf("%s.SFTP.knownHostsFile is required", prefix)
+		}
+
+		return require(prefix+".SFTP",
+			requiredField{"host", t.SFTP.Host},
+			requiredField{"username", t.SFTP.Username},
+		)
+	default:
+		return fmt.Errorf("%s.type %q is not supported", prefix, t.Type)
+	}
+}
+
+func require(prefix string, fields ...requiredField) error {
+	for _, field := range fields {
+		if field.value == "" {
+			return fmt.Errorf("%s.%s is required", prefix, field.name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package config
+
+import "testing"
+
+func TestValidateGridFSTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		gridFS  MigrateTargetGridFS
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "chunk size and buckets", gridFS: MigrateTargetGridFS{ChunkSize: 1 << 20, Buckets: map[string]string{"rocketchat_uploads": "uploads"}}},
+		{name: "negative chunk size", gridFS: MigrateTargetGridFS{ChunkSize: -1}, wantErr: true},
+		{name: "empty bucket name", gridFS: MigrateTargetGridFS{Buckets: map[string]string{"rocketchat_uploads": ""}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := MigrateTarget{Type: "GridFS", GridFS: tt.gridFS}
+
+			err := target.validate("source")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"github.com/RocketChat/filestore-migrator/store"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrInsufficientSpace is returned by DownloadAll when the temp directory can't hold the files that are to be downloaded
+var ErrInsufficientSpace = errors.New("insufficient free space")
+
+// SetRequireFreeSpace makes DownloadAll check that the volume of the temp directory has room for every file before
+// downloading any of them. Files that are already downloaded aren't counted
+func (m *Migrate) SetRequireFreeSpace(require bool) {
+	m.requireFreeSpace = require
+}
+
+// checkFreeSpace compares the size of the files not downloaded yet with the space available in the store's temp directory.
+// Only the ids and sizes of the files are read, so it works without holding all files in memory
+func (m *Migrate) checkFreeSpace(ctx context.Context) error {
+	tempDir := m.storeTempDirectory()
+
+	query := m.fileQuery()
+
+	if err := m.applyStoredOffset(query); err != nil {
+		return err
+	}
+
+	cursor, err := m.findCursor(ctx, query, m.findOptions().SetProjection(bson.M{"_id": 1, "size": 1}))
+	if err != nil {
+		return err
+	}
+
+	defer cursor.Close(ctx)
+
+	var required uint64
+
+	for cursor.Next(ctx) {
+		var file rocketchat.File
+		if err := cursor.Decode(&file); err != nil {
+			return err
+		}
+
+		if file.Size <= 0 {
+			continue
+		}
+
+		if _, err := os.Stat(store.TempFilePath(tempDir, file)); err == nil {
+			continue
+		}
+
+		required += uint64(file.Size)
+	}
+
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	available, err := freeSpace(tempDir)
+	if err != nil {
+		return fmt.Errorf("unable to check the free space of %s: %w", tempDir, err)
+	}
+
+	m.debugf("%d bytes needed in %s, %d bytes available", required, tempDir, available)
+
+	if required > available {
+		return fmt.Errorf("%w: %s has %d bytes available, %d bytes are needed", ErrInsufficientSpace, tempDir, available, required)
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package migrator
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ErrorMode decides how a run reacts to a file that fails
+type ErrorMode int
+
+const (
+	// ErrorModeAbort stops scheduling files after the first failure and returns its error, this is the default
+	ErrorModeAbort ErrorMode = iota
+	// ErrorModeCollect keeps going after failures and returns a *MultiError holding all of them once the run is done
+	ErrorModeCollect
+)
+
+// SetErrorMode sets how failed files are handled. Unlike skipErrors, collected errors are still returned
+func (m *Migrate) SetErrorMode(mode ErrorMode) {
+	m.errorMode = mode
+}
+
+// FileError is the failure of a single file
+type FileError struct {
+	FileID string
+	Err    error
+}
+
+func (e *FileError) Error() string {
+	return e.FileID + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is returned by runs in ErrorModeCollect when files failed, migrations wrap it in a *PartialMigrationError
+type MultiError struct {
+	Errors []*FileError
+
+	mu sync.Mutex
+}
+
+func (e *MultiError) add(fileID string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.Errors = append(e.Errors, &FileError{FileID: fileID, Err: err})
+}
+
+// errOrNil returns e only when it holds errors, so an empty collection doesn't turn into a non-nil error
+func (e *MultiError) errOrNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+func (e *MultiError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		messages = append(messages, err.Error())
+	}
+
+	return fmt.Sprintf("%d files failed: %s", len(e.Errors), strings.Join(messages, "; "))
+}
+
+// PartialMigrationError is returned by migrations in ErrorModeCollect when some files failed while the others were migrated.
+// Result holds the summary of the run, Err the *MultiError with the failed files
+type PartialMigrationError struct {
+	Result *MigrationResult
+	Err    error
+}
+
+func (e *PartialMigrationError) Error() string {
+	return fmt.Sprintf("migration of %s was partial: %s", e.Result.Store, e.Err.Error())
+}
+
+// Unwrap returns the errors of the failed files
+func (e *PartialMigrationError) Unwrap() error {
+	return e.Err
+}
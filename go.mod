@@ -1,14 +1,17 @@
 module github.com/RocketChat/filestore-migrator
 
-go 1.14
+go 1.15
 
 require (
 	cloud.google.com/go v0.49.0 // indirect
+	github.com/Azure/azure-storage-blob-go v0.13.0
 	github.com/golang/groupcache v0.0.0-20191027212112-611e8accdfc9 // indirect
 	github.com/minio/minio-go/v7 v7.0.15
+	github.com/pkg/sftp v1.13.5
 	github.com/smartystreets/goconvey v1.7.2 // indirect
 	go.mongodb.org/mongo-driver v1.12.1
 	go.opencensus.io v0.22.2 // indirect
+	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d
 	golang.org/x/oauth2 v0.0.0-20191202225959-858c2ad4c8b6
 	google.golang.org/api v0.14.0
 	google.golang.org/appengine v1.6.5 // indirect
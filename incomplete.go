@@ -0,0 +1,55 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// RecheckIncomplete looks up files that were skipped for not being completely uploaded, ie. the IncompleteFiles of an
+// earlier MigrationResult, and returns the ids of those that are complete by now and can be migrated with another run.
+// The ids are looked up in the collection of the current store
+func (m *Migrate) RecheckIncomplete(fileIDs []string) ([]string, error) {
+	return m.RecheckIncompleteContext(context.Background(), fileIDs)
+}
+
+// RecheckIncompleteContext looks up previously incomplete files like RecheckIncomplete
+func (m *Migrate) RecheckIncompleteContext(ctx context.Context, fileIDs []string) ([]string, error) {
+	if len(fileIDs) == 0 {
+		return nil, nil
+	}
+
+	fileCollection, ok := m.storeCollection(m.storeName)
+	if !ok {
+		return nil, errors.New("Invalid store Name")
+	}
+
+	if err := m.Connect(); err != nil {
+		return nil, err
+	}
+
+	collection := m.session.Client().Database(m.databaseName).Collection(fileCollection)
+
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": fileIDs}, "complete": true})
+	if err != nil {
+		return nil, err
+	}
+
+	var files []struct {
+		ID string `bson:"_id"`
+	}
+
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+
+	completed := make([]string, 0, len(files))
+	for _, file := range files {
+		completed = append(completed, file.ID)
+	}
+
+	m.infof("%d of %d previously incomplete files of %s are complete now", len(completed), len(fileIDs), m.storeName)
+
+	return completed, nil
+}
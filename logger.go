@@ -0,0 +1,60 @@
+package migrator
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Logger receives the output of the migrator. Debugf is only called in debug mode
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// stdLogger writes timestamped lines through the standard log package, it is used unless SetLogger is called
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, v ...interface{}) {
+	stdLog(format, v...)
+}
+
+func (stdLogger) Infof(format string, v ...interface{}) {
+	stdLog(format, v...)
+}
+
+func (stdLogger) Errorf(format string, v ...interface{}) {
+	stdLog(format, v...)
+}
+
+func stdLog(format string, v ...interface{}) {
+	log.Println(fmt.Sprintf("[%s]", time.Now().Format("01/02/2006 15:04:05")), fmt.Sprintf(format, v...))
+}
+
+// SetLogger routes the migrator output to l, nil restores the default of the standard log package
+func (m *Migrate) SetLogger(l Logger) {
+	m.logger = l
+}
+
+func (m *Migrate) getLogger() Logger {
+	if m.logger == nil {
+		return stdLogger{}
+	}
+
+	return m.logger
+}
+
+func (m *Migrate) debugf(format string, v ...interface{}) {
+	if m.debug {
+		m.getLogger().Debugf(format, v...)
+	}
+}
+
+func (m *Migrate) infof(format string, v ...interface{}) {
+	m.getLogger().Infof(format, v...)
+}
+
+func (m *Migrate) errorf(format string, v ...interface{}) {
+	m.getLogger().Errorf(format, v...)
+}
@@ -4,15 +4,23 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"math/rand"
+	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/RocketChat/filestore-migrator/rocketchat"
 	"github.com/RocketChat/filestore-migrator/store"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type rocketChatSetting struct {
@@ -25,206 +33,1228 @@ func (m *Migrate) DebugMode() {
 	m.debug = true
 }
 
-func (m *Migrate) debugLog(v ...interface{}) {
-	if m.debug {
-		logger(v...)
+// SetFileDelay set the delay between
+func (m *Migrate) SetFileDelay(duration time.Duration) {
+	m.fileDelay = duration
+}
+
+// SetFileDelayJitter randomizes every file delay by up to fraction of it in either direction, ie. 0.5 waits between
+// half and one and a half times the delay, so concurrent workers don't hit the destination in bursts. 0 disables it
+func (m *Migrate) SetFileDelayJitter(fraction float64) error {
+	if fraction < 0 || fraction > 1 {
+		return errors.New("file delay jitter must be between 0 and 1")
 	}
+
+	m.fileDelayJitter = fraction
+
+	return nil
 }
 
-func logger(v ...interface{}) {
-	all := append([]interface{}{fmt.Sprintf("[%s]", time.Now().Format("01/02/2006 15:04:05"))}, v...)
-	log.Println(all...)
+// wait sleeps for the configured file delay, returning early if ctx is cancelled
+func (m *Migrate) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(m.jitteredFileDelay()):
+		return nil
+	}
 }
 
-// SetFileDelay set the delay between
-func (m *Migrate) SetFileDelay(duration time.Duration) {
-	m.fileDelay = duration
+func (m *Migrate) jitteredFileDelay() time.Duration {
+	if m.fileDelayJitter == 0 || m.fileDelay <= 0 {
+		return m.fileDelay
+	}
+
+	spread := float64(m.fileDelay) * m.fileDelayJitter
+
+	return m.fileDelay + time.Duration((rand.Float64()*2-1)*spread)
+}
+
+// SetDryRun enables a mode where no files are uploaded and no documents are updated,
+// the actions that would have been taken are logged instead
+func (m *Migrate) SetDryRun(dryRun bool) {
+	m.dryRun = dryRun
+}
+
+// SetSkipAlreadyMigrated leaves out files whose store already points at the destination store
+func (m *Migrate) SetSkipAlreadyMigrated(skip bool) {
+	m.skipMigrated = skip
+}
+
+// SetRoomFilter limits the Uploads store to files from the given rooms, no rooms means all files
+func (m *Migrate) SetRoomFilter(rids ...string) {
+	m.roomFilter = rids
+}
+
+// SetTypeFilter limits the files to the given content types (ie. image/png), matching is case-insensitive
+func (m *Migrate) SetTypeFilter(types ...string) {
+	m.typeFilter = types
+}
+
+// SetSizeRange limits the files to those between minBytes and maxBytes in size, a zero maxBytes means no upper bound
+func (m *Migrate) SetSizeRange(minBytes int64, maxBytes int64) error {
+	if minBytes < 0 || maxBytes < 0 {
+		return errors.New("size range can't be negative")
+	}
+
+	if maxBytes > 0 && maxBytes < minBytes {
+		return errors.New("maximum size must not be smaller than minimum size")
+	}
+
+	m.minSize = minBytes
+	m.maxSize = maxBytes
+
+	return nil
+}
+
+// SetDeleteSourceAfterMigrate removes each file from the source store once its document points at the destination store
+func (m *Migrate) SetDeleteSourceAfterMigrate(deleteSource bool) {
+	m.deleteSource = deleteSource
+}
+
+// SetUpdateDatabase decides whether migrations and UploadAll point the file documents at the destination store, the default.
+// Without the update files are only copied, eg. to fill a standby store that RepointStore can switch to later,
+// and the source files are never deleted as the documents still reference them
+func (m *Migrate) SetUpdateDatabase(update bool) {
+	m.skipDatabaseUpdate = !update
+}
+
+// ErrSameStore is returned by migrations whose source and destination are the same store, see SetAllowSameStore
+var ErrSameStore = errors.New("source and destination are the same store")
+
+// ErrCompressedDestination is returned by operations that would point the documents at a FileSystem destination with
+// compress set. Rocket.Chat reads such a store as <location>/<file id> without decompressing, so the files would break
+var ErrCompressedDestination = errors.New("documents can't be pointed at a compressed FileSystem store")
+
+// checkCompressedDestination refuses to point documents at a compressed FileSystem destination
+func (m *Migrate) checkCompressedDestination() error {
+	if fileSystem, ok := m.destinationStore.(*store.FileSystemStorageProvider); ok && fileSystem.Compress {
+		return fmt.Errorf("%w, only copy the files with SetUpdateDatabase(false) or disable compress", ErrCompressedDestination)
+	}
+
+	return nil
+}
+
+// SetAllowSameStore allows migrations between a source and destination that are the same store,
+// ie. to reorganize the object paths of a FileSystem store. They are refused by default
+func (m *Migrate) SetAllowSameStore(allow bool) {
+	m.allowSameStore = allow
+}
+
+// SetRateLimit caps the combined download and upload throughput of all workers to bytesPerSecond, zero removes the cap
+func (m *Migrate) SetRateLimit(bytesPerSecond int64) error {
+	if bytesPerSecond < 0 {
+		return errors.New("rate limit can't be negative")
+	}
+
+	var limiter *store.RateLimiter
+	if bytesPerSecond > 0 {
+		limiter = store.NewRateLimiter(bytesPerSecond)
+	}
+
+	if m.sourceStore != nil {
+		m.sourceStore.SetRateLimiter(limiter)
+	}
+
+	if m.destinationStore != nil {
+		m.destinationStore.SetRateLimiter(limiter)
+	}
+
+	return nil
+}
+
+// SetMaxFiles only processes the first n files by upload date, ie. to try out a configuration. 0 removes the limit
+func (m *Migrate) SetMaxFiles(n int) error {
+	if n < 0 {
+		return errors.New("max files can't be negative")
+	}
+
+	m.maxFiles = n
+
+	return nil
+}
+
+// SetMaxConcurrency sets how many files are processed in parallel, taking precedence over MAX_CONCURRENCY
+func (m *Migrate) SetMaxConcurrency(n int) error {
+	if n < 1 {
+		return errors.New("max concurrency must be at least 1")
+	}
+
+	m.maxConcurrency = n
+
+	return nil
+}
+
+// SetDownloadConcurrency sets how many files are downloaded from the source store in parallel. Setting it or
+// SetUploadConcurrency splits migrations into a download and an upload stage with their own workers, the stage
+// left unset uses the max concurrency. Downloaded files wait for an upload worker in a queue as long as there are
+// upload workers, so a fast source doesn't fill the temp directory
+func (m *Migrate) SetDownloadConcurrency(n int) error {
+	if n < 1 {
+		return errors.New("download concurrency must be at least 1")
+	}
+
+	m.downloadConcurrency = n
+
+	return nil
+}
+
+// SetUploadConcurrency sets how many files are uploaded to the destination store in parallel, see SetDownloadConcurrency
+func (m *Migrate) SetUploadConcurrency(n int) error {
+	if n < 1 {
+		return errors.New("upload concurrency must be at least 1")
+	}
+
+	m.uploadConcurrency = n
+
+	return nil
+}
+
+// defaultSettingsCollection is where Rocket.Chat keeps its settings unless the collections are prefixed
+const defaultSettingsCollection = "rocketchat_settings"
+
+// SetSettingsCollection sets the collection the settings, like the uniqueID, are read from. Defaults to rocketchat_settings
+func (m *Migrate) SetSettingsCollection(collection string) error {
+	if collection == "" {
+		return errors.New("settings collection is required")
+	}
+
+	m.settingsCollection = collection
+
+	return nil
+}
+
+// settingsCollectionName returns the collection holding the settings
+func (m *Migrate) settingsCollectionName() string {
+	if m.settingsCollection == "" {
+		return defaultSettingsCollection
+	}
+
+	return m.settingsCollection
+}
+
+// ErrMissingUniqueID is returned when the settings hold no uniqueID and none was set with SetUniqueID
+var ErrMissingUniqueID = errors.New("the uniqueID setting is missing, it is required to build object paths; set it with SetUniqueID")
+
+// SetUniqueID sets the uniqueID object paths are built with instead of reading it from the settings,
+// for instances that don't have the setting
+func (m *Migrate) SetUniqueID(uniqueID string) {
+	m.uniqueID = uniqueID
+}
+
+// loadUniqueID reads the uniqueID from the settings unless it is already known
+func (m *Migrate) loadUniqueID(ctx context.Context, db *mongo.Database) error {
+	if m.uniqueID != "" {
+		return nil
+	}
+
+	var uniqueID rocketChatSetting
+
+	if err := db.Collection(m.settingsCollectionName()).FindOne(ctx, bson.M{"_id": "uniqueID"}).Decode(&uniqueID); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrMissingUniqueID
+		}
+
+		return err
+	}
+
+	if uniqueID.Value == "" {
+		return ErrMissingUniqueID
+	}
+
+	m.debugf("uniqueId %s", uniqueID.Value)
+	m.uniqueID = uniqueID.Value
+
+	return nil
+}
+
+// SetStoreCollection changes the collection the files of an already registered store are read from,
+// eg. for deployments that prefix their collections. Uploads, Avatars and UserDataFiles default to rocketchat_uploads,
+// rocketchat_avatars and rocketchat_user_data_files
+func (m *Migrate) SetStoreCollection(name string, collection string) error {
+	if _, ok := m.storeCollection(name); !ok {
+		return errors.New("Invalid store Name")
+	}
+
+	return m.RegisterStore(name, collection)
+}
+
+// RegisterStore makes a store name usable with SetStoreName, reading its files from the given collection.
+// Uploads, Avatars and UserDataFiles, the exports of Rocket.Chat's user data download, are registered by default
+func (m *Migrate) RegisterStore(name string, collection string) error {
+	if name == "" || collection == "" {
+		return errors.New("store name and collection are required")
+	}
+
+	if m.storeCollections == nil {
+		m.storeCollections = defaultStoreCollections()
+	}
+
+	m.storeCollections[name] = collection
+
+	return nil
+}
+
+func defaultStoreCollections() map[string]string {
+	return map[string]string{
+		"Uploads":       "rocketchat_uploads",
+		"Avatars":       "rocketchat_avatars",
+		"UserDataFiles": "rocketchat_user_data_files",
+	}
+}
+
+// storeCollection returns the collection holding the files of a store
+func (m *Migrate) storeCollection(storeName string) (string, bool) {
+	if m.storeCollections == nil {
+		m.storeCollections = defaultStoreCollections()
+	}
+
+	collection, ok := m.storeCollections[storeName]
+
+	return collection, ok
+}
+
+// storeNames returns the registered store names in a stable order
+func (m *Migrate) storeNames() []string {
+	if m.storeCollections == nil {
+		m.storeCollections = defaultStoreCollections()
+	}
+
+	names := make([]string, 0, len(m.storeCollections))
+	for name := range m.storeCollections {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
 }
 
 // SetStoreName that will be operating on
 func (m *Migrate) SetStoreName(storeName string) error {
-	if storeName != "Uploads" && storeName != "Avatars" {
+	if _, ok := m.storeCollection(storeName); !ok {
 		return errors.New("Invalid Store Name")
 	}
 
 	m.storeName = storeName
 
+	return m.useStoreTempDirectory()
+}
+
+// useStoreTempDirectory points the stores at the temp directory of the current store. It runs again before every operation,
+// so it doesn't matter whether the stores were attached before or after the store name was set
+func (m *Migrate) useStoreTempDirectory() error {
+	if err := m.ensureStoreTempDirectory(); err != nil {
+		return err
+	}
+
 	if m.sourceStore != nil {
-		m.sourceStore.SetTempDirectory(m.tempFileLocation + "/" + strings.ToLower(storeName))
+		m.sourceStore.SetTempDirectory(m.storeTempDirectory())
 	}
 
 	if m.destinationStore != nil {
-		m.destinationStore.SetTempDirectory(m.tempFileLocation + "/" + strings.ToLower(storeName))
+		m.destinationStore.SetTempDirectory(m.storeTempDirectory())
 	}
 
 	return nil
 }
 
-func (m *Migrate) getFiles() ([]rocketchat.File, error) {
+// SetCleanupTempFiles removes each downloaded file once it is migrated and the store's temp directory after a successful MigrateStore.
+// DownloadAll always keeps its files
+func (m *Migrate) SetCleanupTempFiles(cleanup bool) {
+	m.cleanupTempFiles = cleanup
+}
+
+func (m *Migrate) storeTempDirectory() string {
+	return m.tempFileLocation + "/" + strings.ToLower(m.storeName)
+}
+
+// ensureStoreTempDirectory creates the store's temp directory, it may have been removed by a previous cleanup
+func (m *Migrate) ensureStoreTempDirectory() error {
+	tempDir := m.storeTempDirectory()
+
+	if _, err := os.Stat(tempDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(tempDir, 0777); err != nil {
+			m.debugf("%v", err)
+			return errors.New("Temp Directory doesn't exist and unable to create it")
+		}
+	}
+
+	return nil
+}
+
+func (m *Migrate) getFiles(ctx context.Context) ([]rocketchat.File, error) {
 	if m.storeName == "" {
 		return nil, errors.New("no store Name")
 	}
 
-	m.debugLog("Store: ", m.storeName)
+	if err := m.useStoreTempDirectory(); err != nil {
+		return nil, err
+	}
 
-	fileCollection := ""
+	query := m.fileQuery()
 
-	switch m.storeName {
-	case "Uploads":
-		fileCollection = "rocketchat_uploads"
-	case "Avatars":
-		fileCollection = "rocketchat_avatars"
-	default:
+	if err := m.applyStoredOffset(query); err != nil {
+		return nil, err
+	}
+
+	files, err := m.findFiles(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		m.checkSourceStore(ctx)
+	}
+
+	return m.filterCheckpointed(files)
+}
+
+// checkSourceStore logs the stores the files are actually in when none of them are in the source store,
+// which usually means the wrong source type was picked
+func (m *Migrate) checkSourceStore(ctx context.Context) {
+	sourceStoreField := m.sourceStore.StoreType() + ":" + m.storeName
+
+	collection := m.session.Client().Database(m.databaseName).Collection(m.fileCollectionName)
+
+	inSource, err := collection.CountDocuments(ctx, bson.M{"store": m.sourceStoreMatch()})
+	if err != nil || inSource > 0 {
+		return
+	}
+
+	stores, err := collection.Distinct(ctx, "store", bson.M{})
+	if err != nil {
+		m.debugf("unable to list the stores of %s: %v", m.fileCollectionName, err)
+		return
+	}
+
+	if len(stores) == 0 {
+		return
+	}
+
+	found := make([]string, 0, len(stores))
+	for _, s := range stores {
+		found = append(found, fmt.Sprint(s))
+	}
+
+	m.errorf("No files of %s are in %s, the files in %s are in: %s. Check the source store type",
+		m.storeName, sourceStoreField, m.fileCollectionName, strings.Join(found, ", "))
+}
+
+// countAlreadyMigrated logs how many files matching the filters are already in the destination store. A re-run only
+// picks up files still in the source store, so these are skipped without ever being looked at
+func (m *Migrate) countAlreadyMigrated(ctx context.Context) int {
+	destinationStoreField := m.destinationStore.StoreType() + ":" + m.storeName
+	if destinationStoreField == m.sourceStore.StoreType()+":"+m.storeName {
+		return 0
+	}
+
+	query := m.fileQuery()
+	query["store"] = destinationStoreField
+
+	collection := m.session.Client().Database(m.databaseName).Collection(m.fileCollectionName)
+
+	migrated, err := collection.CountDocuments(ctx, query)
+	if err != nil {
+		m.debugf("unable to count the files already in %s: %v", destinationStoreField, err)
+		return 0
+	}
+
+	if migrated > 0 {
+		m.infof("%d files of %s already migrated to %s, skipping", migrated, m.storeName, m.destinationStore.StoreType())
+	}
+
+	return int(migrated)
+}
+
+// findFiles connects to the database and returns the files of the store matching query
+func (m *Migrate) findFiles(ctx context.Context, query bson.M) ([]rocketchat.File, error) {
+	return m.findFilesWithOptions(ctx, query, m.findOptions())
+}
+
+// findFilesWithOptions returns the files of the store matching query, sorted and limited by findOptions
+func (m *Migrate) findFilesWithOptions(ctx context.Context, query bson.M, findOptions *options.FindOptions) ([]rocketchat.File, error) {
+	cursor, err := m.findCursor(ctx, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []rocketchat.File
+
+	if err = cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// findCursor connects to the database and opens a cursor over the files of the store matching query
+func (m *Migrate) findCursor(ctx context.Context, query bson.M, findOptions *options.FindOptions) (*mongo.Cursor, error) {
+	if m.storeName == "" {
+		return nil, errors.New("no store Name")
+	}
+
+	m.debugf("Store: %s", m.storeName)
+
+	fileCollection, ok := m.storeCollection(m.storeName)
+	if !ok {
 		return nil, errors.New("Invalid store Name")
 	}
 
-	m.fileCollectionName = fileCollection
+	m.fileCollectionName = fileCollection
+
+	if err := m.Connect(); err != nil {
+		return nil, err
+	}
+
+	db := m.session.Client().Database(m.databaseName)
+
+	if err := m.loadUniqueID(ctx, db); err != nil {
+		return nil, err
+	}
+
+	collection := db.Collection(fileCollection)
+
+	m.debugf("%s %v", fileCollection, query)
+
+	var cursor *mongo.Cursor
+
+	err := m.withDatabaseRetry(ctx, "Find of "+fileCollection, func() (err error) {
+		cursor, err = collection.Find(ctx, query, findOptions)
+		return err
+	})
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errors.New("No files found")
+		}
+
+		return nil, err
+	}
+
+	return cursor, nil
+}
+
+// findOptions returns the files oldest first, so runs resumed with SetFileOffset pick up exactly where they stopped,
+// limited to the first maxFiles
+func (m *Migrate) findOptions() *options.FindOptions {
+	findOptions := options.Find().SetSort(bson.D{{Key: "uploadedAt", Value: 1}, {Key: "_id", Value: 1}})
+
+	if m.maxFiles > 0 {
+		findOptions.SetLimit(int64(m.maxFiles))
+	}
+
+	if m.cursorBatchSize > 0 {
+		findOptions.SetBatchSize(int32(m.cursorBatchSize))
+	}
+
+	return findOptions
+}
+
+// SetCursorBatchSize makes MigrateStore and DownloadAll read the files from the database while they are processed,
+// n at a time, instead of loading all of them up front. Zero, the default, loads all files first
+func (m *Migrate) SetCursorBatchSize(n int) error {
+	if n < 0 {
+		return errors.New("cursor batch size can't be negative")
+	}
+
+	m.cursorBatchSize = n
+
+	return nil
+}
+
+// openFiles returns the files getFiles would, along with their number. With a cursor batch size they are read
+// from the database as the run asks for them, the returned func closes the cursor
+func (m *Migrate) openFiles(ctx context.Context) (fileSource, int, func(), error) {
+	if m.cursorBatchSize == 0 {
+		files, err := m.getFiles(ctx)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		return sliceSource(files), len(files), func() {}, nil
+	}
+
+	if m.storeName == "" {
+		return nil, 0, nil, errors.New("no store Name")
+	}
+
+	if err := m.useStoreTempDirectory(); err != nil {
+		return nil, 0, nil, err
+	}
+
+	query := m.fileQuery()
+
+	if err := m.applyStoredOffset(query); err != nil {
+		return nil, 0, nil, err
+	}
+
+	cursor, err := m.findCursor(ctx, query, m.findOptions())
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	closeCursor := func() { cursor.Close(context.Background()) }
+
+	countOptions := options.Count()
+	if m.maxFiles > 0 {
+		countOptions.SetLimit(int64(m.maxFiles))
+	}
+
+	total, err := m.session.Client().Database(m.databaseName).Collection(m.fileCollectionName).CountDocuments(ctx, query, countOptions)
+	if err != nil {
+		closeCursor()
+		return nil, 0, nil, err
+	}
+
+	if total == 0 {
+		m.checkSourceStore(ctx)
+	}
+
+	completed := make(map[string]struct{})
+	if m.checkpointFile != "" {
+		if completed, err = loadCheckpoint(m.checkpointFile); err != nil {
+			closeCursor()
+			return nil, 0, nil, err
+		}
+	}
+
+	next := func(ctx context.Context) (rocketchat.File, bool, error) {
+		for cursor.Next(ctx) {
+			var file rocketchat.File
+			if err := cursor.Decode(&file); err != nil {
+				return rocketchat.File{}, false, err
+			}
+
+			// The checkpointed files are still counted in total, they are skipped here
+			if _, ok := completed[file.ID]; ok {
+				continue
+			}
+
+			return file, true, nil
+		}
+
+		return rocketchat.File{}, false, cursor.Err()
+	}
+
+	return next, int(total), closeCursor, nil
+}
+
+// SetLegacyStoreFields sets further values of the store field that mark files of the source store, ie. GridFS
+// for documents of old Rocket.Chat versions that left out the store name. They are matched ignoring case
+func (m *Migrate) SetLegacyStoreFields(fields ...string) {
+	m.legacyStoreFields = fields
+}
+
+// sourceStoreValues returns the store field of the source store followed by the legacy store fields
+func (m *Migrate) sourceStoreValues() []interface{} {
+	values := []interface{}{m.sourceStore.StoreType() + ":" + m.storeName}
+
+	for _, field := range m.legacyStoreFields {
+		values = append(values, primitive.Regex{Pattern: "^" + regexp.QuoteMeta(field) + "$", Options: "i"})
+	}
+
+	return values
+}
+
+// sourceStoreMatch returns the filter on the store field matching the files of the source store
+func (m *Migrate) sourceStoreMatch() interface{} {
+	if len(m.legacyStoreFields) == 0 {
+		return m.sourceStore.StoreType() + ":" + m.storeName
+	}
+
+	return bson.M{"$in": m.sourceStoreValues()}
+}
+
+// fileQuery builds the filter used to find the files of the store that should be processed
+func (m *Migrate) fileQuery() bson.M {
+	sourceStoreField := m.sourceStore.StoreType() + ":" + m.storeName
+
+	query := bson.M{"store": m.sourceStoreMatch()}
+
+	if m.skipMigrated && m.destinationStore != nil {
+		destinationStoreField := m.destinationStore.StoreType() + ":" + m.storeName
+
+		if destinationStoreField != sourceStoreField {
+			storeMatch := bson.M{"$eq": sourceStoreField, "$ne": destinationStoreField}
+			if len(m.legacyStoreFields) > 0 {
+				storeMatch = bson.M{"$in": m.sourceStoreValues(), "$ne": destinationStoreField}
+			}
+
+			query["store"] = storeMatch
+		} else {
+			m.debugf("Source and destination share the store %s, already migrated files can't be told apart", sourceStoreField)
+		}
+	}
+
+	m.addFileFilters(query)
+
+	return query
+}
+
+// addFileFilters narrows query down to the files within the offsets, rooms, types and sizes the run is limited to
+func (m *Migrate) addFileFilters(query bson.M) {
+	if !m.fileOffset.IsZero() || !m.fileOffsetEnd.IsZero() {
+		uploadedAt := bson.M{}
+		if !m.fileOffset.IsZero() {
+			uploadedAt["$gte"] = m.fileOffset
+		}
+
+		if !m.fileOffsetEnd.IsZero() {
+			uploadedAt["$lte"] = m.fileOffsetEnd
+		}
+
+		query["uploadedAt"] = uploadedAt
+	}
+
+	if len(m.roomFilter) > 0 && m.storeName == "Uploads" {
+		query["rid"] = bson.M{"$in": m.roomFilter}
+	}
+
+	if len(m.typeFilter) > 0 {
+		types := make([]interface{}, 0, len(m.typeFilter))
+		for _, t := range m.typeFilter {
+			types = append(types, primitive.Regex{Pattern: "^" + regexp.QuoteMeta(t) + "$", Options: "i"})
+		}
+
+		query["type"] = bson.M{"$in": types}
+	}
+
+	if m.minSize > 0 || m.maxSize > 0 {
+		size := bson.M{}
+		if m.minSize > 0 {
+			size["$gte"] = m.minSize
+		}
+
+		if m.maxSize > 0 {
+			size["$lte"] = m.maxSize
+		}
+
+		query["size"] = size
+	}
+}
+
+// MigrateStore migrates a filestore between source and destination
+func (m *Migrate) MigrateStore() error {
+	return m.MigrateStoreContext(context.Background())
+}
+
+// MigrateStoreContext migrates a filestore between source and destination.
+// Once ctx is cancelled no further files are migrated and ctx.Err() is returned
+func (m *Migrate) MigrateStoreContext(ctx context.Context) error {
+	_, err := m.MigrateStoreResultContext(ctx)
+	return err
+}
+
+// MigrateStoreResult migrates a filestore between source and destination and returns a summary of the run
+func (m *Migrate) MigrateStoreResult() (*MigrationResult, error) {
+	return m.MigrateStoreResultContext(context.Background())
+}
+
+// MigrateStoreResultContext migrates a filestore between source and destination and returns a summary of the run.
+// The summary is returned along with any error so partial runs can be inspected
+func (m *Migrate) MigrateStoreResultContext(ctx context.Context) (*MigrationResult, error) {
+	if m.sourceStore == nil || m.destinationStore == nil {
+		return nil, errors.New("For MigrateStore both a source and destionation store must be provided")
+	}
+
+	if !m.allowSameStore && store.SameTarget(m.sourceStore, m.destinationStore) {
+		return nil, fmt.Errorf("%w: %s", ErrSameStore, m.sourceStore.StoreType())
+	}
+
+	if !m.skipDatabaseUpdate {
+		if err := m.checkCompressedDestination(); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.reportFile == "" {
+		return m.migrateStore(ctx)
+	}
+
+	m.report = &migrationReport{
+		Store:            m.storeName,
+		SourceStore:      m.sourceStore.StoreType(),
+		DestinationStore: m.destinationStore.StoreType(),
+		StartedAt:        time.Now(),
+		Files:            []reportRecord{},
+	}
+
+	defer func() { m.report = nil }()
+
+	result, err := m.migrateStore(ctx)
+
+	if writeErr := m.writeReport(result, err); writeErr != nil {
+		m.errorf("unable to write report %s: %v", m.reportFile, writeErr)
+	}
+
+	return result, err
+}
+
+// MigrateAllStores migrates every registered store one after the other and returns the combined summary,
+// the summary of each store is in its Stores
+func (m *Migrate) MigrateAllStores() (*MigrationResult, error) {
+	return m.MigrateAllStoresContext(context.Background())
+}
+
+// MigrateAllStoresContext migrates every registered store one after the other and returns the combined summary.
+// The first store that fails stops the run, the store name set before the call is restored afterwards
+func (m *Migrate) MigrateAllStoresContext(ctx context.Context) (*MigrationResult, error) {
+	storeNames := m.storeNames()
+
+	previousStoreName := m.storeName
+	defer func() {
+		if previousStoreName != "" {
+			m.SetStoreName(previousStoreName)
+		}
+	}()
+
+	total := &MigrationResult{}
+
+	for _, storeName := range storeNames {
+		if err := m.SetStoreName(storeName); err != nil {
+			return total, err
+		}
+
+		m.infof("Migrating store %s", storeName)
+
+		result, err := m.MigrateStoreResultContext(ctx)
+		total.merge(result)
+
+		if result != nil {
+			total.Stores = append(total.Stores, result)
+		}
+
+		if err != nil {
+			return total, fmt.Errorf("store %s: %w", storeName, err)
+		}
+	}
+
+	m.infof("Migrated all stores, %s", total.summary())
+
+	return total, nil
+}
+
+func (m *Migrate) migrateStore(ctx context.Context) (*MigrationResult, error) {
+	files, total, closeFiles, err := m.openFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeFiles()
+
+	m.debugf("Found %v files", total)
+
+	if err := m.ensureStoreTempDirectory(); err != nil {
+		return nil, err
+	}
+
+	closeCheckpoint, err := m.openCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeCheckpoint()
+
+	result := &MigrationResult{Store: m.storeName, Total: total, AlreadyMigrated: m.countAlreadyMigrated(ctx)}
+
+	m.result = result
+	defer func() { m.result = nil }()
+
+	atomic.StoreInt64(&m.dryRunCount, 0)
+
+	start := time.Now()
+
+	storeOffset := m.startOffsetTracking()
+
+	if m.stagedConcurrency() {
+		err = m.forEachFileStaged(ctx, files, total, m.downloadForMigration, m.uploadDownloaded)
+	} else {
+		err = m.forEachFileFrom(ctx, files, total, m.migrateFile)
+	}
+
+	// Files already uploaded get their documents updated even when the run is cut short
+	if flushErr := m.flushUpdates(context.Background()); err == nil {
+		err = flushErr
+	}
+
+	// Also after a cut short run, the offset only covers the files done without gaps
+	if offsetErr := storeOffset(); err == nil {
+		err = offsetErr
+	}
+
+	result.finish(start)
+
+	if multiErr, ok := err.(*MultiError); ok {
+		err = &PartialMigrationError{Result: result, Err: multiErr}
+	}
+
+	if err != nil {
+		return result, err
+	}
+
+	if m.dryRun {
+		m.infof("Dry run: %v of %v files would have been migrated", atomic.LoadInt64(&m.dryRunCount), total)
+	} else {
+		m.infof("Migrated %s", result.summary())
+	}
+
+	if !m.dryRun && m.cleanupTempFiles {
+		// Only after a clean run, the temp files of failed runs are kept for inspection
+		if err := os.RemoveAll(m.storeTempDirectory()); err != nil {
+			m.errorf("Failed to remove temp directory %s: %v", m.storeTempDirectory(), err)
+		}
+	}
+
+	m.debugf("Finished!")
+
+	return result, nil
+}
+
+// migrateFile moves a single file from the source to the destination store and points its document at the destination
+func (m *Migrate) migrateFile(ctx context.Context, index int, total int, file rocketchat.File) error {
+	downloaded, ok, err := m.downloadForMigration(ctx, index, total, file)
+	if err != nil || !ok {
+		return err
+	}
+
+	return m.uploadDownloaded(ctx, total, downloaded)
+}
+
+// downloadForMigration fetches a file from the source store into the temp directory, ok is false when the file is done
+// with, ie. skipped. Files already in the destination or streamed to it are returned without a path
+func (m *Migrate) downloadForMigration(ctx context.Context, index int, total int, file rocketchat.File) (stagedFile, bool, error) {
+	m.debugf("[%v/%v] Downloading %s from: %s", index, total, file.Name, m.sourceStore.StoreType())
+
+	if !file.Complete {
+		m.debugf("[%v/%v] File wasn't completed uploading for %s Skipping", index, total, file.Name)
+		m.progress(file, index, total, PhaseSkipped, ErrFileIncomplete)
+
+		return stagedFile{}, false, nil
+	}
+
+	m.fillFileDefaults(&file)
+
+	objectPath, err := m.getObjectPath(&file)
+	if err != nil {
+		m.progress(file, index, total, PhaseUploading, err)
+		return stagedFile{}, false, err
+	}
+
+	if m.dryRun {
+		m.infof("[%v/%v] Dry run: would migrate %s from %s to %s: %s", index, total, file.Name, m.sourceStore.StoreType(), m.destinationStore.StoreType(), objectPath)
+		atomic.AddInt64(&m.dryRunCount, 1)
+
+		return stagedFile{}, false, nil
+	}
+
+	staged := stagedFile{index: index, objectPath: objectPath}
+
+	switch {
+	case m.skipIfDestinationExists && m.destinationHasFile(ctx, objectPath, file):
+		m.infof("[%v/%v] %s is already in %s at %s, only updating its document", index, total, file.Name, m.destinationStore.StoreType(), objectPath)
+	case m.canStream() && !m.stagedConcurrency():
+		// Streaming uploads while downloading, there is nothing for a separate upload stage to do
+		skipped, err := m.streamFile(ctx, index, total, &file, objectPath)
+		if err != nil || skipped {
+			return stagedFile{}, false, err
+		}
+	default:
+		m.progress(file, index, total, PhaseDownloading, nil)
+
+		err = m.withRetry(ctx, "Download of "+file.Name, func() (err error) {
+			staged.path, err = m.sourceStore.Download(m.fileCollectionName, file)
+			return err
+		})
+		if err != nil {
+			if m.skipFailedDownload(file, index, total, err) {
+				return stagedFile{}, false, nil
+			}
+
+			m.progress(file, index, total, PhaseDownloading, err)
+
+			return stagedFile{}, false, err
+		}
+
+		m.addBytes(fileSize(staged.path), 0)
+
+		m.sniffContentType(&file, staged.path)
+	}
+
+	staged.file = file
+
+	return staged, true, nil
+}
+
+// uploadDownloaded sends a file returned by downloadForMigration to the destination store and points its document at it
+func (m *Migrate) uploadDownloaded(ctx context.Context, total int, staged stagedFile) error {
+	file := staged.file
+	index := staged.index
+	objectPath := staged.objectPath
+	downloadedPath := staged.path
+
+	if downloadedPath != "" {
+		size := fileSize(downloadedPath)
+
+		m.debugf("[%v/%v] Uploading to %s to: %s", index, total, m.destinationStore.StoreType(), objectPath)
+		m.progress(file, index, total, PhaseUploading, nil)
+
+		if err := m.withRetry(ctx, "Upload of "+file.Name, func() error {
+			return m.destinationStore.Upload(objectPath, downloadedPath, file.Type)
+		}); err != nil {
+			m.progress(file, index, total, PhaseUploading, err)
+			return err
+		}
+
+		m.addBytes(0, size)
+
+		if m.verifyChecksum {
+			if err := m.verifyUpload(objectPath, downloadedPath, file); err != nil {
+				m.progress(file, index, total, PhaseUploading, err)
+				return err
+			}
+		}
+	}
+
+	if tagger, ok := m.destinationStore.(store.Tagger); ok {
+		if err := m.withRetry(ctx, "Tagging of "+file.Name, func() error {
+			return tagger.TagObject(objectPath, file, m.storeName)
+		}); err != nil {
+			m.progress(file, index, total, PhaseUploading, err)
+			return err
+		}
+	}
+
+	pending := pendingUpdate{
+		index: index,
+		total: total,
+	}
+
+	if m.cleanupTempFiles && downloadedPath != "" {
+		pending.tempFile = downloadedPath
+	}
+
+	if m.skipDatabaseUpdate {
+		pending.file = file
+		m.finishUpdate(pending)
+
+		return m.wait(ctx)
+	}
 
-	session, err := connectDB(m.connectionString)
-	if err != nil {
-		return nil, err
+	if m.deleteSource {
+		// Keep the source references around, fixFileForUpload clears them
+		sourceFile := file
+		pending.sourceFile = &sourceFile
 	}
 
-	m.session = session
+	unset := m.fixFileForUpload(&file, objectPath)
 
-	db := session.Client().Database(m.databaseName)
+	pending.file = file
+	pending.update = fileUpdate(file, unset)
 
-	settingsCollection := db.Collection("rocketchat_settings")
+	if err := m.updateFile(ctx, pending); err != nil {
+		return err
+	}
 
-	var uniqueID rocketChatSetting
+	return m.wait(ctx)
+}
 
-	if err := settingsCollection.FindOne(context.TODO(), bson.M{"_id": "uniqueID"}).Decode(&uniqueID); err != nil {
-		return nil, err
+// skipFailedDownload skips a file that couldn't be downloaded when it is missing from the source store, or for any
+// error with skipErrors set. Both are logged apart so a missing file can be told from a failing store
+func (m *Migrate) skipFailedDownload(file rocketchat.File, index int, total int, err error) bool {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		m.infof("[%v/%v] No corresponding file for %s in %s, skipping as missing", index, total, file.Name, m.sourceStore.StoreType())
+	case m.skipErrors:
+		m.errorf("[%v/%v] %s skipped due to error: %v", index, total, file.Name, err)
+	default:
+		return false
 	}
 
-	m.debugLog("uniqueId", uniqueID)
-	m.uniqueID = uniqueID.Value
+	m.progress(file, index, total, PhaseSkipped, err)
 
-	collection := db.Collection(fileCollection)
+	return true
+}
 
-	var files []rocketchat.File
+// deleteSourceFile removes a migrated file from the source store. The document already points at the destination,
+// so a failure only leaves an orphaned object behind and is logged instead of failing the file
+func (m *Migrate) deleteSourceFile(index int, total int, file rocketchat.File) {
+	if m.sourceStore.StoreType() == m.destinationStore.StoreType() && !m.distinctFileSystems() {
+		m.infof("[%v/%v] Not deleting %s, source and destination are both %s", index, total, file.Name, m.sourceStore.StoreType())
+		return
+	}
 
-	m.debugLog(fileCollection, m.sourceStore.StoreType()+":"+m.storeName)
+	objectPath := m.sourceObjectPath(file)
+	if objectPath == "" {
+		m.errorf("[%v/%v] Not deleting %s, its document has no path in %s", index, total, file.Name, m.sourceStore.StoreType())
+		return
+	}
 
-	query := bson.M{"store": m.sourceStore.StoreType() + ":" + m.storeName}
+	m.debugf("[%v/%v] Deleting %s from %s: %s", index, total, file.Name, m.sourceStore.StoreType(), objectPath)
 
-	if !m.fileOffset.IsZero() {
-		query["uploadedAt"] = bson.M{"$gte": m.fileOffset}
+	// Only the exact object, deleting by prefix would take the objects of other files starting with the same key along
+	if err := m.sourceStore.DeleteObject(objectPath); err != nil {
+		m.errorf("[%v/%v] Failed to delete %s from %s: %v", index, total, file.Name, m.sourceStore.StoreType(), err)
 	}
+}
 
-	if cursor, err := collection.Find(context.TODO(), query); err != nil {
-		if err == mongo.ErrNoDocuments {
-			return nil, errors.New("No files found")
-		}
+// sourceObjectPath returns the key the file is read from in the source store, empty when the document has none
+func (m *Migrate) sourceObjectPath(file rocketchat.File) string {
+	if referencePath := storeReferencePath(m.sourceStore.StoreType(), file); referencePath != "" {
+		return referencePath
+	}
 
-		return nil, err
-	} else {
-		if err = cursor.All(context.TODO(), &files); err != nil {
-			return nil, err
-		}
+	switch m.sourceStore.StoreType() {
+	case "FileSystem", "WebDAV", "SFTP":
+		// Files without a path are stored by ID
+		return file.ID
+	case "GridFS":
+		return m.fileCollectionName + "/" + file.ID
 	}
 
-	return files, nil
+	return ""
 }
 
-// MigrateStore migrates a filestore between source and destination
-func (m *Migrate) MigrateStore() error {
-	if m.sourceStore == nil || m.destinationStore == nil {
-		return errors.New("For MigrateStore both a source and destionation store must be provided")
+// fillFileDefaults fills the fields uploads are keyed by like Rocket.Chat does when they are missing
+func (m *Migrate) fillFileDefaults(file *rocketchat.File) {
+	if m.storeName != "Uploads" {
+		return
 	}
 
-	files, err := m.getFiles()
-	if err != nil {
-		return err
+	if file.Rid == "" {
+		file.Rid = "undefined"
+	}
+
+	if file.UserID == "" {
+		file.UserID = "undefined"
 	}
+}
 
-	m.debugLog(fmt.Sprintf("Found %v files\n", len(files)))
+// sniffContentType fills in the type of files older Rocket.Chat versions saved without one from the content at path,
+// otherwise the object is served as application/octet-stream and images no longer show inline
+func (m *Migrate) sniffContentType(file *rocketchat.File, path string) {
+	if file.Type != "" {
+		return
+	}
 
-	for i, file := range files {
-		index := i + 1 // for logs
+	f, err := os.Open(path)
+	if err != nil {
+		m.debugf("unable to sniff the type of %s: %v", file.Name, err)
+		return
+	}
 
-		m.debugLog(fmt.Sprintf("[%v/%v] Downloading %s from: %s\n", index, len(files), file.Name, m.sourceStore.StoreType()))
+	defer f.Close()
 
-		if !file.Complete {
-			m.debugLog(fmt.Sprintf("[%v/%v] File wasn't completed uploading for %s Skipping\n", index, len(files), file.Name))
-			continue
-		}
+	head := make([]byte, 512)
 
-		downloadedPath, err := m.sourceStore.Download(m.fileCollectionName, file)
-		if err != nil {
-			if err == store.ErrNotFound || m.skipErrors {
-				m.debugLog(fmt.Sprintf("[%v/%v] No corresponding file for %s Skipping\n", index, len(files), file.Name))
-				err = nil
-				continue
-			} else {
-				return err
-			}
-		}
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		m.debugf("unable to sniff the type of %s: %v", file.Name, err)
+		return
+	}
 
-		if file.Rid == "" && m.storeName == "Uploads" {
-			file.Rid = "undefined"
-		}
+	file.Type = http.DetectContentType(head[:n])
 
-		if file.UserID == "" {
-			file.UserID = "undefined"
-		}
+	m.debugf("%s has no type, detected %s", file.Name, file.Type)
+}
 
-		objectPath := m.getObjectPath(&file)
+// AvatarKey is the field of an avatar document its object is keyed by in the default layout
+type AvatarKey int
 
-		m.debugLog(fmt.Sprintf("[%v/%v] Uploading to %s to: %s\n", index, len(files), m.destinationStore.StoreType(), objectPath))
+const (
+	// AvatarKeyUserID keys avatars by user id, this is the default
+	AvatarKeyUserID AvatarKey = iota
+	// AvatarKeyUsername keys avatars by the username of the document, avatars without one fall back to the user id
+	AvatarKeyUsername
+)
 
-		if err := m.destinationStore.Upload(objectPath, downloadedPath, file.Type); err != nil {
-			return err
-		}
+// SetAvatarKey sets the field avatar objects are keyed by, it has to match how the existing avatar store is laid out
+func (m *Migrate) SetAvatarKey(key AvatarKey) {
+	m.avatarKey = key
+}
 
-		unset := m.fixFileForUpload(&file, objectPath)
+// avatarObjectKey is what an avatar is stored under. User avatars are keyed by user, room avatars carry no user
+// and fall back to the room, so they don't all end up on the same object
+func (m *Migrate) avatarObjectKey(file *rocketchat.File) string {
+	if m.avatarKey == AvatarKeyUsername && file.Username != "" {
+		return file.Username
+	}
 
-		update := bson.M{
-			"$set": file,
-		}
+	if file.UserID != "" {
+		return file.UserID
+	}
 
-		if unset != "" {
-			update["$unset"] = bson.M{unset: 1}
-		}
+	if file.Rid != "" {
+		return file.Rid
+	}
 
-		db := m.session.Client().Database(m.databaseName)
-		collection := db.Collection(m.fileCollectionName)
+	return file.ID
+}
 
-		if _, err := collection.UpdateOne(context.TODO(), bson.M{"_id": file.ID}, update); err != nil {
-			return err
-		}
+// distinctFileSystems reports whether source and destination are FileSystem stores with different locations
+func (m *Migrate) distinctFileSystems() bool {
+	source, ok := m.sourceStore.(*store.FileSystemStorageProvider)
+	if !ok {
+		return false
+	}
+
+	destination, ok := m.destinationStore.(*store.FileSystemStorageProvider)
+	if !ok {
+		return false
+	}
 
-		m.debugLog(fmt.Sprintf("[%v/%v] Completed Uploading %s\n", index, len(files), file.Name))
+	return filepath.Clean(source.Location) != filepath.Clean(destination.Location)
+}
 
-		time.Sleep(m.fileDelay)
+func (m *Migrate) getObjectPath(file *rocketchat.File) (string, error) {
+	switch m.destinationStore.StoreType() {
+	case "FileSystem":
+		// Rocket.Chat's FileSystem store resolves a file as <location>/<file id> no matter what the document's path says.
+		// Only an explicit template, ie. to reorganize a FileSystem store, lays files out differently
+		if m.objectPathTemplate == nil {
+			return file.ID, nil
+		}
 
+		return m.renderObjectPath(file)
+	case "GridFS":
+		// GridFS keys the file by ID inside the bucket named after the collection
+		return m.fileCollectionName + "/" + file.ID, nil
 	}
 
-	m.debugLog("Finished!")
+	if m.objectPathTemplate != nil {
+		objectPath, err := m.renderObjectPath(file)
+		if err != nil {
+			return "", err
+		}
 
-	return nil
-}
+		return m.withDestinationPrefix(objectPath), nil
+	}
 
-func (m *Migrate) getObjectPath(file *rocketchat.File) string {
 	objectPath := ""
 
 	switch m.storeName {
 	case "Uploads":
 		objectPath = fmt.Sprintf("%s/%s/%s/%s/%s", m.uniqueID, strings.ToLower(m.storeName), file.Rid, file.UserID, file.ID)
 	case "Avatars":
-		objectPath = fmt.Sprintf("%s/%s/%s", m.uniqueID, strings.ToLower(m.storeName), file.UserID)
-	}
-
-	// FileSystem just dumps them in the folder based on the ID
-	if m.destinationStore.StoreType() == "FileSystem" {
-		objectPath = file.ID
+		objectPath = fmt.Sprintf("%s/%s/%s", m.uniqueID, strings.ToLower(m.storeName), m.avatarObjectKey(file))
+	case "UserDataFiles":
+		// The exports belong to a user, not a room
+		objectPath = fmt.Sprintf("%s/%s/%s/%s", m.uniqueID, strings.ToLower(m.storeName), file.UserID, file.ID)
+		if file.UserID == "" {
+			objectPath = fmt.Sprintf("%s/%s/%s", m.uniqueID, strings.ToLower(m.storeName), file.ID)
+		}
+	default:
+		objectPath = fmt.Sprintf("%s/%s/%s", m.uniqueID, strings.ToLower(m.storeName), file.ID)
 	}
 
-	return objectPath
+	return m.withDestinationPrefix(objectPath), nil
 }
 
-func (m *Migrate) fixFileForUpload(file *rocketchat.File, objectPath string) string {
-	unset := ""
+func (m *Migrate) fixFileForUpload(file *rocketchat.File, objectPath string) []string {
+	var unset []string
+
+	if m.preserveOriginalStore {
+		preserveOriginalStore(file)
+	}
 
 	switch m.destinationStore.StoreType() {
 	case "AmazonS3":
@@ -232,31 +1262,98 @@ func (m *Migrate) fixFileForUpload(file *rocketchat.File, objectPath string) str
 			Path: objectPath,
 		}
 
-		// Set to empty object so won't be saved back
-		unset = "GoogleStorage"
-		file.GoogleStorage = rocketchat.GoogleStorage{}
-
+		unset = clearStoreReferences(file, "AmazonS3")
 	case "GoogleCloudStorage":
 		file.GoogleStorage = rocketchat.GoogleStorage{
 			Path: objectPath,
 		}
 
-		// Set to empty object so won't be saved back
-		unset = "AmazonS3"
-		file.AmazonS3 = rocketchat.AmazonS3{}
-	case "FileSystem":
+		unset = clearStoreReferences(file, "GoogleStorage")
+	case "AzureBlobStorage":
+		file.AzureBlobStorage = rocketchat.AzureBlobStorage{
+			Path: objectPath,
+		}
+
+		unset = clearStoreReferences(file, "AzureBlobStorage")
+	case "WebDAV":
+		file.WebDAV = rocketchat.WebDAV{
+			Path: objectPath,
+		}
+
+		unset = clearStoreReferences(file, "WebDAV")
+	case "SFTP":
+		file.SFTP = rocketchat.SFTP{
+			Path: objectPath,
+		}
+
+		unset = clearStoreReferences(file, "SFTP")
 	default:
+		// FileSystem and GridFS files are found by ID, the document only carries the ufs route it is served from.
+		// A leftover sub document of the previous store confuses Rocket.Chat's store resolution
+		unset = clearStoreReferences(file, "")
 	}
 
-	ufsPath := fmt.Sprintf("/ufs/%s:%s/%s/%s", m.destinationStore.StoreType(), m.storeName, file.ID, file.Name)
+	ufsPath := fmt.Sprintf("/ufs/%s:%s/%s/%s", m.destinationStore.StoreType(), m.storeName, file.ID, ufsFileName(file.Name))
 
 	file.URL = ufsPath
 	file.Path = ufsPath
 	file.Store = m.destinationStore.StoreType() + ":" + m.storeName
 
+	m.mutateDocument(file)
+
+	return unset
+}
+
+// storeReferences are the sub documents pointing a file at its object in a store
+var storeReferences = []string{"AmazonS3", "GoogleStorage", "AzureBlobStorage", "WebDAV", "SFTP"}
+
+// clearStoreReferences empties the sub documents of every store but keep, so they won't be saved back,
+// and returns them to be unset
+func clearStoreReferences(file *rocketchat.File, keep string) []string {
+	var unset []string
+
+	for _, reference := range storeReferences {
+		if reference == keep {
+			continue
+		}
+
+		switch reference {
+		case "AmazonS3":
+			file.AmazonS3 = rocketchat.AmazonS3{}
+		case "GoogleStorage":
+			file.GoogleStorage = rocketchat.GoogleStorage{}
+		case "AzureBlobStorage":
+			file.AzureBlobStorage = rocketchat.AzureBlobStorage{}
+		case "WebDAV":
+			file.WebDAV = rocketchat.WebDAV{}
+		case "SFTP":
+			file.SFTP = rocketchat.SFTP{}
+		}
+
+		unset = append(unset, reference)
+	}
+
 	return unset
 }
 
+// fileUpdate builds the update document that sets the file and unsets the given fields
+func fileUpdate(file rocketchat.File, unset []string) bson.M {
+	update := bson.M{
+		"$set": file,
+	}
+
+	if len(unset) > 0 {
+		unsetFields := bson.M{}
+		for _, field := range unset {
+			unsetFields[field] = 1
+		}
+
+		update["$unset"] = unsetFields
+	}
+
+	return update
+}
+
 // SetFileOffset sets an offset for file upload/downloads
 func (m *Migrate) SetFileOffset(offset time.Time) error {
 	if offset.IsZero() {
@@ -268,110 +1365,364 @@ func (m *Migrate) SetFileOffset(offset time.Time) error {
 	return nil
 }
 
+// ResumeFromLastMigrated sets the file offset to the upload date of the newest file already in the destination store,
+// so a stopped migration picks up around where it left off. Nothing is changed when no file was migrated yet
+func (m *Migrate) ResumeFromLastMigrated() error {
+	if m.destinationStore == nil {
+		return errors.New("For ResumeFromLastMigrated must have a destination store provided")
+	}
+
+	fileCollection, ok := m.storeCollection(m.storeName)
+	if !ok {
+		return errors.New("Invalid store Name")
+	}
+
+	if err := m.Connect(); err != nil {
+		return err
+	}
+
+	collection := m.session.Client().Database(m.databaseName).Collection(fileCollection)
+
+	var last rocketchat.File
+
+	err := collection.FindOne(context.Background(),
+		bson.M{"store": m.destinationStore.StoreType() + ":" + m.storeName},
+		options.FindOne().SetSort(bson.D{{Key: "uploadedAt", Value: -1}}),
+	).Decode(&last)
+	if err == mongo.ErrNoDocuments {
+		m.infof("No files of %s are in %s yet, starting from the beginning", m.storeName, m.destinationStore.StoreType())
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	m.fileOffset = last.UploadedAt
+
+	m.infof("Resuming %s from files uploaded at or after %s", m.storeName, last.UploadedAt.Format(time.RFC3339))
+
+	return nil
+}
+
+// SetFileDateRange only processes files uploaded between start and end, both included.
+// A zero start or end leaves that side of the range open
+func (m *Migrate) SetFileDateRange(start time.Time, end time.Time) error {
+	if !start.IsZero() && !end.IsZero() && end.Before(start) {
+		return errors.New("end of the date range is before its start")
+	}
+
+	m.fileOffset = start
+	m.fileOffsetEnd = end
+
+	return nil
+}
+
 // DownloadAll downloads all files from a filestore
 func (m *Migrate) DownloadAll() error {
+	return m.DownloadAllContext(context.Background())
+}
+
+// DownloadAllContext downloads all files from a filestore.
+// Once ctx is cancelled no further files are downloaded and ctx.Err() is returned
+func (m *Migrate) DownloadAllContext(ctx context.Context) error {
 	if m.sourceStore == nil {
 		return errors.New("For DownloadAll must have a source store provided")
 	}
 
-	files, err := m.getFiles()
+	files, total, closeFiles, err := m.openFiles(ctx)
 	if err != nil {
 		return err
 	}
 
-	m.debugLog(fmt.Sprintf("Found %v files\n", len(files)))
+	defer closeFiles()
 
-	for i, file := range files {
-		index := i + 1 // for logs
+	m.debugf("Found %v files", total)
 
-		m.debugLog(fmt.Sprintf("[%v/%v] Downloading %s from: %s\n", index, len(files), file.Name, m.sourceStore.StoreType()))
+	if err := m.ensureStoreTempDirectory(); err != nil {
+		return err
+	}
 
-		if !file.Complete {
-			fmt.Printf("[%v/%v] rocketchat.File wasn't completed uploading for %s Skipping\n", index, len(files), file.Name)
-			continue
+	if m.requireFreeSpace {
+		if err := m.checkFreeSpace(ctx); err != nil {
+			return err
 		}
+	}
 
-		if _, err := m.sourceStore.Download(m.fileCollectionName, file); err != nil {
-			if err == store.ErrNotFound || m.skipErrors {
-				fmt.Printf("[%v/%v] No corresponding file for %s Skipping\n", index, len(files), file.Name)
-				err = nil
-				continue
-			} else {
-				return err
-			}
-		}
+	closeCheckpoint, err := m.openCheckpoint()
+	if err != nil {
+		return err
+	}
 
-		m.debugLog(fmt.Sprintf("[%v/%v] Downloaded %s from: %s\n", index, len(files), file.Name, m.sourceStore.StoreType()))
+	defer closeCheckpoint()
 
-		time.Sleep(m.fileDelay)
+	if err := m.forEachFileFrom(ctx, files, total, m.downloadFile); err != nil {
+		return err
 	}
 
-	m.debugLog("Finished!")
+	m.debugf("Finished!")
 
 	return nil
 }
 
+// downloadFile downloads a single file from the source store into the temp file location
+func (m *Migrate) downloadFile(ctx context.Context, index int, total int, file rocketchat.File) error {
+	m.debugf("[%v/%v] Downloading %s from: %s", index, total, file.Name, m.sourceStore.StoreType())
+
+	if !file.Complete {
+		m.infof("[%v/%v] rocketchat.File wasn't completed uploading for %s Skipping", index, total, file.Name)
+		m.progress(file, index, total, PhaseSkipped, ErrFileIncomplete)
+
+		return nil
+	}
+
+	m.progress(file, index, total, PhaseDownloading, nil)
+
+	var downloadedPath string
+
+	if err := m.withRetry(ctx, "Download of "+file.Name, func() (err error) {
+		downloadedPath, err = m.sourceStore.Download(m.fileCollectionName, file)
+		return err
+	}); err != nil {
+		if m.skipFailedDownload(file, index, total, err) {
+			return nil
+		}
+
+		m.progress(file, index, total, PhaseDownloading, err)
+
+		return err
+	}
+
+	m.addBytes(fileSize(downloadedPath), 0)
+
+	if m.readableDownloads {
+		readablePath, err := m.moveToReadablePath(downloadedPath, file)
+		if err != nil {
+			m.progress(file, index, total, PhaseDownloading, err)
+			return err
+		}
+
+		downloadedPath = readablePath
+	}
+
+	m.debugf("[%v/%v] Downloaded %s from %s to: %s", index, total, file.Name, m.sourceStore.StoreType(), downloadedPath)
+	m.progress(file, index, total, PhaseCompleted, nil)
+
+	return m.wait(ctx)
+}
+
 // UploadAll uploads all files from a filestore
 func (m *Migrate) UploadAll(filesRoot string) error {
-	if m.destinationStore == nil {
-		return errors.New("For UploadAll must have a destination store provided")
+	return m.UploadAllContext(context.Background(), filesRoot)
+}
+
+// UploadAllContext uploads all files from a filestore.
+// Once ctx is cancelled no further files are uploaded and ctx.Err() is returned
+func (m *Migrate) UploadAllContext(ctx context.Context, filesRoot string) error {
+	_, err := m.UploadAllResultContext(ctx, filesRoot)
+	return err
+}
+
+// UploadAllResult uploads all files from a filestore and returns a summary of the run,
+// MissingFiles lists the files that weren't found below filesRoot
+func (m *Migrate) UploadAllResult(filesRoot string) (*MigrationResult, error) {
+	return m.UploadAllResultContext(context.Background(), filesRoot)
+}
+
+// UploadAllResultContext uploads all files from a filestore and returns a summary of the run.
+// The summary is returned along with any error so partial runs can be inspected
+func (m *Migrate) UploadAllResultContext(ctx context.Context, filesRoot string) (*MigrationResult, error) {
+	if m.sourceStore == nil || m.destinationStore == nil {
+		return nil, errors.New("For UploadAll both a source and destination store must be provided")
+	}
+
+	if !m.skipDatabaseUpdate {
+		if err := m.checkCompressedDestination(); err != nil {
+			return nil, err
+		}
 	}
 
-	files, err := m.getFiles()
+	files, err := m.getFiles(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	m.debugf("Found %v files in database", len(files))
+
+	closeCheckpoint, err := m.openCheckpoint()
+	if err != nil {
+		return nil, err
 	}
 
-	m.debugLog(fmt.Sprintf("Found %v files in database\n", len(files)))
+	defer closeCheckpoint()
 
-	filesRoot = filesRoot + "/" + strings.ToLower(m.storeName)
+	if m.sourceLayout == SourceLayoutByID {
+		filesRoot = filesRoot + "/" + strings.ToLower(m.storeName)
+	}
 
-	for i, file := range files {
-		index := i + 1 // for logs
+	result := &MigrationResult{Store: m.storeName, Total: len(files), AlreadyMigrated: m.countAlreadyMigrated(ctx)}
 
-		fileLocation := filesRoot + "/" + file.ID
+	m.result = result
+	defer func() { m.result = nil }()
 
-		if _, err := os.Stat(fileLocation); os.IsNotExist(err) {
-			log.Println("Failed to locate: ", file.Name)
-			continue
-		}
+	atomic.StoreInt64(&m.dryRunCount, 0)
 
-		m.debugLog(fmt.Sprintf("[%v/%v] Uploading %s to: %s\n", index, len(files), file.Name, m.destinationStore.StoreType()))
+	start := time.Now()
 
-		if !file.Complete {
-			fmt.Printf("[%v/%v] rocketchat.File wasn't completed uploading for %s Skipping\n", index, len(files), file.Name)
-			continue
-		}
+	storeOffset := m.startOffsetTracking()
+
+	err = m.forEachFile(ctx, files, func(ctx context.Context, index int, total int, file rocketchat.File) error {
+		return m.uploadLocalFile(ctx, filesRoot, index, total, file)
+	})
+
+	// Files already uploaded get their documents updated even when the run is cut short
+	if flushErr := m.flushUpdates(context.Background()); err == nil {
+		err = flushErr
+	}
+
+	// Also after a cut short run, the offset only covers the files done without gaps
+	if offsetErr := storeOffset(); err == nil {
+		err = offsetErr
+	}
+
+	result.finish(start)
+
+	if len(result.MissingFiles) > 0 {
+		m.infof("%v files couldn't be found in %s", len(result.MissingFiles), filesRoot)
+	}
+
+	if err != nil {
+		return result, err
+	}
+
+	if m.dryRun {
+		m.infof("Dry run: %v of %v files would have been uploaded", atomic.LoadInt64(&m.dryRunCount), len(files))
+	} else {
+		m.infof("Uploaded %s", result.summary())
+	}
+
+	m.debugf("Finished!")
+
+	return result, nil
+}
+
+// SourceLayout is how the files UploadAll uploads are laid out below filesRoot
+type SourceLayout int
+
+const (
+	// SourceLayoutByID expects files at <filesRoot>/<store>/<file id> as written by DownloadAll, this is the default
+	SourceLayoutByID SourceLayout = iota
+	// SourceLayoutUFS expects the directory of a Rocket.Chat FileSystem store, holding the files of every store
+	// at <filesRoot>/<file id> or <filesRoot>/<file id>.<extension>
+	SourceLayoutUFS
+)
+
+// SetSourceLayout sets where UploadAll looks for the files below filesRoot
+func (m *Migrate) SetSourceLayout(layout SourceLayout) {
+	m.sourceLayout = layout
+}
+
+// localFilePath returns where the file is below filesRoot, the error tells whether it was found
+func (m *Migrate) localFilePath(filesRoot string, file rocketchat.File) (string, error) {
+	fileLocation := filesRoot + "/" + file.ID
 
-		objectPath := m.getObjectPath(&file)
+	_, err := os.Stat(fileLocation)
+	if m.sourceLayout != SourceLayoutUFS || file.Extension == "" || !os.IsNotExist(err) {
+		return fileLocation, err
+	}
+
+	withExtension := fileLocation + "." + file.Extension
+	if _, err := os.Stat(withExtension); err != nil {
+		return fileLocation, err
+	}
+
+	return withExtension, nil
+}
+
+// SetFailOnMissingLocalFile makes UploadAll fail files that aren't found locally instead of skipping them
+func (m *Migrate) SetFailOnMissingLocalFile(fail bool) {
+	m.failOnMissingLocal = fail
+}
+
+// uploadLocalFile uploads a single file found below filesRoot to the destination store and points its document at it,
+// unless updating the database is disabled
+func (m *Migrate) uploadLocalFile(ctx context.Context, filesRoot string, index int, total int, file rocketchat.File) error {
+	fileLocation, err := m.localFilePath(filesRoot, file)
+	if os.IsNotExist(err) {
+		if m.failOnMissingLocal {
+			err := fmt.Errorf("%w: %s", store.ErrNotFound, fileLocation)
+			m.progress(file, index, total, PhaseUploading, err)
 
-		m.debugLog(fmt.Sprintf("[%v/%v] Uploading to %s to: %s\n", index, len(files), m.destinationStore.StoreType(), objectPath))
-		if err := m.destinationStore.Upload(objectPath, fileLocation, file.Type); err != nil {
 			return err
 		}
 
-		unset := m.fixFileForUpload(&file, objectPath)
+		m.infof("Failed to locate: %s", file.Name)
+		m.progress(file, index, total, PhaseSkipped, store.ErrNotFound)
 
-		update := bson.M{
-			"$set": file,
-		}
+		return nil
+	}
 
-		if unset != "" {
-			update["$unset"] = bson.M{unset: 1}
-		}
+	m.debugf("[%v/%v] Uploading %s to: %s", index, total, file.Name, m.destinationStore.StoreType())
+
+	if !file.Complete {
+		m.infof("[%v/%v] rocketchat.File wasn't completed uploading for %s Skipping", index, total, file.Name)
+		m.progress(file, index, total, PhaseSkipped, ErrFileIncomplete)
+
+		return nil
+	}
+
+	m.fillFileDefaults(&file)
+
+	objectPath, err := m.getObjectPath(&file)
+	if err != nil {
+		m.progress(file, index, total, PhaseUploading, err)
+		return err
+	}
+
+	if m.dryRun {
+		m.infof("[%v/%v] Dry run: would upload %s to %s: %s", index, total, file.Name, m.destinationStore.StoreType(), objectPath)
+		atomic.AddInt64(&m.dryRunCount, 1)
+
+		return nil
+	}
+
+	m.sniffContentType(&file, fileLocation)
+
+	m.debugf("[%v/%v] Uploading to %s to: %s", index, total, m.destinationStore.StoreType(), objectPath)
+	m.progress(file, index, total, PhaseUploading, nil)
 
-		collection := m.session.Client().Database(m.databaseName).Collection(m.fileCollectionName)
+	if err := m.withRetry(ctx, "Upload of "+file.Name, func() error {
+		return m.destinationStore.Upload(objectPath, fileLocation, file.Type)
+	}); err != nil {
+		m.progress(file, index, total, PhaseUploading, err)
+		return err
+	}
 
-		if _, err := collection.UpdateOne(context.TODO(), bson.M{"_id": file.ID}, update); err != nil {
+	m.addBytes(0, fileSize(fileLocation))
+
+	if m.verifyChecksum {
+		if err := m.verifyUpload(objectPath, fileLocation, file); err != nil {
+			m.progress(file, index, total, PhaseUploading, err)
 			return err
 		}
+	}
 
-		m.debugLog(fmt.Sprintf("[%v/%v] Completed Uploading %s\n", index, len(files), file.Name))
+	if m.skipDatabaseUpdate {
+		m.finishUpdate(pendingUpdate{file: file, index: index, total: total})
 
-		time.Sleep(m.fileDelay)
+		return m.wait(ctx)
 	}
 
-	m.debugLog("Finished!")
+	unset := m.fixFileForUpload(&file, objectPath)
 
-	return nil
+	if err := m.updateFile(ctx, pendingUpdate{
+		file:   file,
+		update: fileUpdate(file, unset),
+		index:  index,
+		total:  total,
+	}); err != nil {
+		return err
+	}
+
+	return m.wait(ctx)
 }
@@ -0,0 +1,300 @@
+package migrator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"github.com/RocketChat/filestore-migrator/store"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// referencedFile returns a file pointing at objectPath through every store sub document
+func referencedFile(objectPath string) rocketchat.File {
+	return rocketchat.File{
+		ID:               "file-id",
+		Name:             "report.pdf",
+		AmazonS3:         rocketchat.AmazonS3{Path: objectPath},
+		GoogleStorage:    rocketchat.GoogleStorage{Path: objectPath},
+		AzureBlobStorage: rocketchat.AzureBlobStorage{Path: objectPath},
+		WebDAV:           rocketchat.WebDAV{Path: objectPath},
+		SFTP:             rocketchat.SFTP{Path: objectPath},
+	}
+}
+
+// referencePaths returns the path of every store sub document by name
+func referencePaths(file rocketchat.File) map[string]string {
+	return map[string]string{
+		"AmazonS3":         file.AmazonS3.Path,
+		"GoogleStorage":    file.GoogleStorage.Path,
+		"AzureBlobStorage": file.AzureBlobStorage.Path,
+		"WebDAV":           file.WebDAV.Path,
+		"SFTP":             file.SFTP.Path,
+	}
+}
+
+func TestClearStoreReferences(t *testing.T) {
+	for _, keep := range append([]string{""}, storeReferences...) {
+		file := referencedFile("old/path")
+
+		unset := clearStoreReferences(&file, keep)
+
+		var wantUnset []string
+		for _, reference := range storeReferences {
+			if reference != keep {
+				wantUnset = append(wantUnset, reference)
+			}
+		}
+
+		if !reflect.DeepEqual(unset, wantUnset) {
+			t.Errorf("clearStoreReferences(%q) unset = %v, want %v", keep, unset, wantUnset)
+		}
+
+		for reference, path := range referencePaths(file) {
+			if reference == keep && path != "old/path" {
+				t.Errorf("clearStoreReferences(%q) cleared the kept %s", keep, reference)
+			}
+
+			if reference != keep && path != "" {
+				t.Errorf("clearStoreReferences(%q) left %s = %q", keep, reference, path)
+			}
+		}
+	}
+}
+
+func TestFileUpdate(t *testing.T) {
+	tests := []struct {
+		name      string
+		unset     []string
+		wantUnset bson.M
+	}{
+		{name: "nothing to unset"},
+		{name: "unset references", unset: []string{"AmazonS3", "WebDAV"}, wantUnset: bson.M{"AmazonS3": 1, "WebDAV": 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := rocketchat.File{ID: "file-id", Store: "AmazonS3:Uploads"}
+
+			update := fileUpdate(file, tt.unset)
+
+			if !reflect.DeepEqual(update["$set"], file) {
+				t.Errorf("$set = %v, want the file", update["$set"])
+			}
+
+			unset, ok := update["$unset"]
+			if tt.wantUnset == nil {
+				if ok {
+					t.Errorf("$unset = %v, want none", unset)
+				}
+
+				return
+			}
+
+			if !reflect.DeepEqual(unset, tt.wantUnset) {
+				t.Errorf("$unset = %v, want %v", unset, tt.wantUnset)
+			}
+		})
+	}
+}
+
+func TestFixFileForUploadDocumentShape(t *testing.T) {
+	destinations := []struct {
+		provider  store.Provider
+		reference string
+	}{
+		{provider: &store.FileSystemStorageProvider{}},
+		{provider: &store.GridFSProvider{}},
+		{provider: &store.S3Provider{}, reference: "AmazonS3"},
+		{provider: &store.GoogleStorageProvider{}, reference: "GoogleStorage"},
+		{provider: &store.AzureBlobProvider{}, reference: "AzureBlobStorage"},
+		{provider: &store.WebDAVProvider{}, reference: "WebDAV"},
+		{provider: &store.SFTPProvider{}, reference: "SFTP"},
+	}
+
+	for _, source := range append([]string{""}, storeReferences...) {
+		for _, destination := range destinations {
+			t.Run(source+"->"+destination.provider.StoreType(), func(t *testing.T) {
+				m := &Migrate{storeName: "Uploads", destinationStore: destination.provider}
+
+				file := rocketchat.File{ID: "file-id", Name: "report.pdf", Store: "FileSystem:Uploads"}
+				if source != "" {
+					file = referencedFile("old/path")
+					file.Store = "Source:Uploads"
+					clearStoreReferences(&file, source)
+				}
+
+				unset := m.fixFileForUpload(&file, "new/path")
+
+				wantStore := destination.provider.StoreType() + ":Uploads"
+				if file.Store != wantStore {
+					t.Errorf("Store = %q, want %q", file.Store, wantStore)
+				}
+
+				wantPath := "/ufs/" + wantStore + "/file-id/report.pdf"
+				if file.Path != wantPath || file.URL != wantPath {
+					t.Errorf("Path = %q, URL = %q, want %q", file.Path, file.URL, wantPath)
+				}
+
+				for reference, path := range referencePaths(file) {
+					if reference == destination.reference && path != "new/path" {
+						t.Errorf("%s = %q, want new/path", reference, path)
+					}
+
+					if reference != destination.reference && path != "" {
+						t.Errorf("%s = %q, want it cleared", reference, path)
+					}
+				}
+
+				// Every reference but the destination's is unset, so no stale sub document survives in the database
+				var wantUnset []string
+				for _, reference := range storeReferences {
+					if reference != destination.reference {
+						wantUnset = append(wantUnset, reference)
+					}
+				}
+
+				sort.Strings(unset)
+				sort.Strings(wantUnset)
+
+				if !reflect.DeepEqual(unset, wantUnset) {
+					t.Errorf("unset = %v, want %v", unset, wantUnset)
+				}
+
+				raw, err := bson.Marshal(fileUpdate(file, unset))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var update struct {
+					Set   bson.M `bson:"$set"`
+					Unset bson.M `bson:"$unset"`
+				}
+
+				if err := bson.Unmarshal(raw, &update); err != nil {
+					t.Fatal(err)
+				}
+
+				for _, reference := range storeReferences {
+					_, set := update.Set[reference]
+					_, unsetField := update.Unset[reference]
+
+					if reference == destination.reference && (!set || unsetField) {
+						t.Errorf("update doesn't set %s: %v", reference, update)
+					}
+
+					if reference != destination.reference && (set || !unsetField) {
+						t.Errorf("update doesn't unset %s: %v", reference, update)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestFileSystemDestinationPathConsistency(t *testing.T) {
+	destination := &store.FileSystemStorageProvider{Location: t.TempDir(), TempFileLocation: t.TempDir()}
+	m := &Migrate{storeName: "Uploads", uniqueID: "unique-id", destinationStore: destination}
+
+	file := rocketchat.File{ID: "file-id", Name: "report.pdf", Rid: "room-id", UserID: "user-id", Store: "AmazonS3:Uploads"}
+
+	objectPath, err := m.getObjectPath(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if objectPath != file.ID {
+		t.Fatalf("getObjectPath() = %q, want the file id %q", objectPath, file.ID)
+	}
+
+	sourcePath := filepath.Join(t.TempDir(), "source")
+	if err := ioutil.WriteFile(sourcePath, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := destination.Upload(objectPath, sourcePath, "application/pdf"); err != nil {
+		t.Fatal(err)
+	}
+
+	m.fixFileForUpload(&file, objectPath)
+
+	// Rocket.Chat serves the document's route and reads the file from <location>/<file id>
+	if !strings.Contains(file.Path, "/"+file.ID+"/") {
+		t.Errorf("Path = %q, want it to route to the file id %q", file.Path, file.ID)
+	}
+
+	if _, err := os.Stat(filepath.Join(destination.Location, file.ID)); err != nil {
+		t.Errorf("file isn't where Rocket.Chat reads it from: %v", err)
+	}
+
+	path, err := destination.Download("rocketchat_uploads", file)
+	if err != nil {
+		t.Fatalf("Download() of the written document error = %v", err)
+	}
+
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != "content" {
+		t.Errorf("Download() content = %q, %v, want %q", content, err, "content")
+	}
+}
+
+func TestAvatarObjectPathWithoutRoom(t *testing.T) {
+	tests := []struct {
+		name string
+		file rocketchat.File
+		want string
+	}{
+		{name: "user avatar", file: rocketchat.File{ID: "file-1", UserID: "user-id"}, want: "unique-id/avatars/user-id"},
+		{name: "room avatar", file: rocketchat.File{ID: "file-2", Rid: "room-id"}, want: "unique-id/avatars/room-id"},
+		{name: "neither user nor room", file: rocketchat.File{ID: "file-3"}, want: "unique-id/avatars/file-3"},
+	}
+
+	m := &Migrate{storeName: "Avatars", uniqueID: "unique-id", destinationStore: &store.S3Provider{}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := tt.file
+
+			m.fillFileDefaults(&file)
+
+			if file.Rid != tt.file.Rid || file.UserID != tt.file.UserID {
+				t.Errorf("fillFileDefaults() changed the avatar to rid %q, userId %q", file.Rid, file.UserID)
+			}
+
+			objectPath, err := m.getObjectPath(&file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if objectPath != tt.want {
+				t.Errorf("getObjectPath() = %q, want %q", objectPath, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindOptionsSortByUploadOrder(t *testing.T) {
+	wantSort := bson.D{{Key: "uploadedAt", Value: 1}, {Key: "_id", Value: 1}}
+
+	for _, maxFiles := range []int{0, 10} {
+		m := &Migrate{maxFiles: maxFiles}
+
+		findOptions := m.findOptions()
+
+		if !reflect.DeepEqual(findOptions.Sort, wantSort) {
+			t.Errorf("maxFiles %d: sort = %v, want %v", maxFiles, findOptions.Sort, wantSort)
+		}
+
+		if maxFiles == 0 && findOptions.Limit != nil {
+			t.Errorf("maxFiles 0: limit = %d, want none", *findOptions.Limit)
+		}
+
+		if maxFiles > 0 && (findOptions.Limit == nil || *findOptions.Limit != int64(maxFiles)) {
+			t.Errorf("maxFiles %d: limit = %v, want %d", maxFiles, findOptions.Limit, maxFiles)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package migrator
+
+import (
+	"time"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+)
+
+// The metrics emitted to a MetricsSink. Every metric carries the store label with the name of the store being run
+const (
+	// MetricFiles counts the files that are done, labelled with their outcome
+	MetricFiles = "filestore_migrator_files_total"
+	// MetricBytes counts the bytes transferred, labelled with their direction
+	MetricBytes = "filestore_migrator_bytes_total"
+	// MetricFileDuration observes how long a file took since it was picked up, labelled with its outcome
+	MetricFileDuration = "filestore_migrator_file_duration"
+)
+
+// The values of the outcome label
+const (
+	OutcomeMigrated = "migrated"
+	OutcomeSkipped  = "skipped"
+	OutcomeFailed   = "failed"
+)
+
+// The values of the direction label
+const (
+	DirectionDownloaded = "downloaded"
+	DirectionUploaded   = "uploaded"
+)
+
+// MetricsSink receives the metrics of a run as they happen. It is wired to Prometheus, StatsD or OpenTelemetry by the
+// caller, so the migrator doesn't depend on any of them. With concurrency enabled it is called from multiple goroutines
+type MetricsSink interface {
+	IncCounter(name string, delta float64, labels map[string]string)
+	ObserveDuration(name string, d time.Duration, labels map[string]string)
+}
+
+// SetMetricsSink makes MigrateStore, MigrateAllStores, DownloadAll, UploadAll and RepointStore emit their metrics
+// to sink, nil stops the metrics
+func (m *Migrate) SetMetricsSink(sink MetricsSink) {
+	m.metrics = sink
+}
+
+// observeFile emits the outcome and duration of a file once the file is done
+func (m *Migrate) observeFile(file rocketchat.File, event ProgressEvent) {
+	if m.metrics == nil {
+		return
+	}
+
+	done := event.Phase == PhaseCompleted || event.Phase == PhaseSkipped || event.Err != nil
+
+	started, ok := m.fileStarts.Load(file.ID)
+	if !done {
+		if !ok {
+			m.fileStarts.Store(file.ID, time.Now())
+		}
+
+		return
+	}
+
+	var duration time.Duration
+	if ok {
+		duration = time.Since(started.(time.Time))
+		m.fileStarts.Delete(file.ID)
+	}
+
+	outcome := OutcomeMigrated
+
+	switch {
+	case event.Phase == PhaseSkipped:
+		outcome = OutcomeSkipped
+	case event.Err != nil:
+		outcome = OutcomeFailed
+	}
+
+	m.metrics.IncCounter(MetricFiles, 1, map[string]string{"store": m.storeName, "outcome": outcome})
+	m.metrics.ObserveDuration(MetricFileDuration, duration, map[string]string{"store": m.storeName, "outcome": outcome})
+}
+
+// addBytes counts transferred bytes in the result of the run and the metrics
+func (m *Migrate) addBytes(downloaded int64, uploaded int64) {
+	m.result.addBytes(downloaded, uploaded)
+
+	if m.metrics == nil {
+		return
+	}
+
+	if downloaded > 0 {
+		m.metrics.IncCounter(MetricBytes, float64(downloaded), map[string]string{"store": m.storeName, "direction": DirectionDownloaded})
+	}
+
+	if uploaded > 0 {
+		m.metrics.IncCounter(MetricBytes, float64(uploaded), map[string]string{"store": m.storeName, "direction": DirectionUploaded})
+	}
+}
@@ -2,13 +2,20 @@ package migrator
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/RocketChat/filestore-migrator/config"
+	"github.com/RocketChat/filestore-migrator/rocketchat"
 	"github.com/RocketChat/filestore-migrator/store"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -19,30 +26,83 @@ import (
 
 // Migrate needs to be initialized to begin any migration
 type Migrate struct {
-	storeName          string
-	skipErrors         bool
-	sourceStore        store.Provider
-	destinationStore   store.Provider
-	databaseName       string
-	connectionString   string
-	fileCollectionName string
-	fileOffset         time.Time
-	session            mongo.Session
-	uniqueID           string
-	tempFileLocation   string
-	fileDelay          time.Duration
-	debug              bool
+	storeName               string
+	skipErrors              bool
+	sourceStore             store.Provider
+	destinationStore        store.Provider
+	databaseName            string
+	connectionString        string
+	databaseTLS             config.DatabaseTLSConfig
+	settingsCollection      string
+	fileCollectionName      string
+	fileOffset              time.Time
+	fileOffsetEnd           time.Time
+	session                 mongo.Session
+	sessionMu               sync.Mutex
+	uniqueID                string
+	tempFileLocation        string
+	fileDelay               time.Duration
+	fileDelayJitter         float64
+	maxConcurrency          int
+	downloadConcurrency     int
+	uploadConcurrency       int
+	cursorBatchSize         int
+	retryAttempts           int
+	retryBaseDelay          time.Duration
+	databaseRetryTimeout    time.Duration
+	dryRun                  bool
+	dryRunCount             int64
+	progressHandler         func(ProgressEvent)
+	metrics                 MetricsSink
+	fileStarts              sync.Map
+	result                  *MigrationResult
+	skipMigrated            bool
+	roomFilter              []string
+	typeFilter              []string
+	minSize                 int64
+	maxSize                 int64
+	verifyChecksum          bool
+	deleteSource            bool
+	skipDatabaseUpdate      bool
+	allowSameStore          bool
+	presignedDownloads      bool
+	legacyStoreFields       []string
+	preserveOriginalStore   bool
+	checkpointFile          string
+	checkpoint              *checkpoint
+	debug                   bool
+	logger                  Logger
+	storeCollections        map[string]string
+	cleanupTempFiles        bool
+	errorMode               ErrorMode
+	objectPathTemplate      *template.Template
+	updateBatchSize         int
+	updates                 updateBatch
+	readableDownloads       bool
+	failOnMissingLocal      bool
+	gracePeriod             time.Duration
+	runMu                   sync.Mutex
+	stopRun                 context.CancelFunc
+	shutdown                bool
+	readableMu              sync.Mutex
+	reportFile              string
+	skipIfDestinationExists bool
+	destinationPrefix       string
+	maxFiles                int
+	completed               int64
+	requireFreeSpace        bool
+	avatarKey               AvatarKey
+	sourceLayout            SourceLayout
+	documentMutator         func(*rocketchat.File)
+	offsetStoreFile         string
+	offsets                 *offsetWatermark
+	report                  *migrationReport
 }
 
 // New takes the config and returns an initialized Migrate ready to begin migrations
 func New(config *config.Config, skipErrors bool) (*Migrate, error) {
-
-	if config.Database.ConnectionString == "" {
-		return nil, errors.New("Missing connectionString for Rocket.Chat's Mongo")
-	}
-
-	if config.Database.Database == "" {
-		return nil, errors.New("Missing db for Rocket.Chat's DB")
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
 
 	if config.TempFileLocation == "" {
@@ -64,63 +124,69 @@ func New(config *config.Config, skipErrors bool) (*Migrate, error) {
 	}
 
 	migrate := &Migrate{
-		skipErrors:       skipErrors,
-		databaseName:     config.Database.Database,
-		connectionString: config.Database.ConnectionString,
-		tempFileLocation: config.TempFileLocation,
-		fileDelay:        fileDelay,
-		debug:            config.DebugMode,
+		skipErrors:         skipErrors,
+		databaseName:       config.Database.Database,
+		connectionString:   config.Database.ConnectionString,
+		databaseTLS:        config.Database.TLS,
+		settingsCollection: config.Database.SettingsCollection,
+		tempFileLocation:   config.TempFileLocation,
+		fileDelay:          fileDelay,
+		fileDelayJitter:    config.FileDelayJitter,
+		debug:              config.DebugMode,
+		storeCollections:   defaultStoreCollections(),
 	}
 
 	if _, err := os.Stat(config.TempFileLocation + "/uploads"); os.IsNotExist(err) {
 		if err := os.MkdirAll(config.TempFileLocation+"/uploads", 0777); err != nil {
-			migrate.debugLog(err)
+			migrate.debugf("%v", err)
 			return nil, errors.New("Temp Directory doesn't exist and unable to create it")
 		}
 	}
 
 	if _, err := os.Stat(config.TempFileLocation + "/avatars"); os.IsNotExist(err) {
 		if err := os.MkdirAll(config.TempFileLocation+"/avatars", 0777); err != nil {
-			migrate.debugLog(err)
+			migrate.debugf("%v", err)
 			return nil, errors.New("Temp Directory doesn't exist and unable to create it")
 		}
 	}
 
+	created := false
+
+	// Don't leave the connection of a GridFS store open when the configuration turns out to be invalid
+	defer func() {
+		if !created {
+			migrate.Close()
+		}
+	}()
+
 	if config.Source.Type != "" {
 
 		switch config.Source.Type {
 		case "GridFS":
-			session, err := connectDB(config.Database.ConnectionString)
-			if err != nil {
+			if err := migrate.Connect(); err != nil {
 				return nil, err
 			}
 
 			sourceStore := &store.GridFSProvider{
 				Database:         config.Database.Database,
-				Session:          session,
+				Session:          migrate.session,
 				TempFileLocation: config.TempFileLocation,
+				BucketNames:      config.Source.GridFS.Buckets,
 				Buckets:          make(map[string]*gridfs.Bucket),
 			}
 
 			migrate.sourceStore = sourceStore
 
 		case "GoogleStorage":
-			if (config.Source.GoogleStorage.Bucket == "" || config.Source.GoogleStorage.JSONKey == "") && !config.Source.ReferenceOnly {
-				return nil, errors.New("Make sure you include all of the required options for GoogleStorage")
-			}
-
 			sourceStore := &store.GoogleStorageProvider{
 				JSONKey:          config.Source.GoogleStorage.JSONKey,
+				JSONKeyFile:      config.Source.GoogleStorage.JSONKeyFile,
 				Bucket:           config.Source.GoogleStorage.Bucket,
 				TempFileLocation: config.TempFileLocation,
 			}
 
 			migrate.sourceStore = sourceStore
 		case "AmazonS3":
-			if (config.Source.AmazonS3.AccessID == "" || config.Source.AmazonS3.AccessKey == "" || config.Source.AmazonS3.Bucket == "") && !config.Source.ReferenceOnly {
-				return nil, errors.New("Make sure you include all of the required options for AmazonS3")
-			}
-
 			sourceStore := &store.S3Provider{
 				Endpoint:         config.Source.AmazonS3.Endpoint,
 				AccessID:         config.Source.AmazonS3.AccessID,
@@ -128,15 +194,23 @@ func New(config *config.Config, skipErrors bool) (*Migrate, error) {
 				Region:           config.Source.AmazonS3.Region,
 				Bucket:           config.Source.AmazonS3.Bucket,
 				UseSSL:           config.Source.AmazonS3.UseSSL,
+				ForcePathStyle:   config.Source.AmazonS3.ForcePathStyle,
 				TempFileLocation: config.TempFileLocation,
 			}
 
 			migrate.sourceStore = sourceStore
-		case "FileSystem":
-			if config.Source.FileSystem.Location == "" && !config.Source.ReferenceOnly {
-				return nil, errors.New("Make sure you include all of the required options for FileSystem")
+		case "AzureBlobStorage":
+			sourceStore := &store.AzureBlobProvider{
+				AccountName:      config.Source.AzureBlobStorage.AccountName,
+				AccountKey:       config.Source.AzureBlobStorage.AccountKey,
+				ConnectionString: config.Source.AzureBlobStorage.ConnectionString,
+				Endpoint:         config.Source.AzureBlobStorage.Endpoint,
+				Container:        config.Source.AzureBlobStorage.Container,
+				TempFileLocation: config.TempFileLocation,
 			}
 
+			migrate.sourceStore = sourceStore
+		case "FileSystem":
 			config.Source.FileSystem.Location = strings.TrimSuffix(config.Source.FileSystem.Location, "/")
 
 			if !config.Source.ReferenceOnly {
@@ -148,6 +222,32 @@ func New(config *config.Config, skipErrors bool) (*Migrate, error) {
 			sourceStore := &store.FileSystemStorageProvider{
 				Location:         config.Source.FileSystem.Location,
 				TempFileLocation: config.TempFileLocation,
+				Compress:         config.Source.FileSystem.Compress,
+			}
+
+			migrate.sourceStore = sourceStore
+		case "WebDAV":
+			sourceStore := &store.WebDAVProvider{
+				URL:              config.Source.WebDAV.URL,
+				Username:         config.Source.WebDAV.Username,
+				Password:         config.Source.WebDAV.Password,
+				TempFileLocation: config.TempFileLocation,
+			}
+
+			migrate.sourceStore = sourceStore
+		case "SFTP":
+			sourceStore := &store.SFTPProvider{
+				Host:                  config.Source.SFTP.Host,
+				Port:                  config.Source.SFTP.Port,
+				Username:              config.Source.SFTP.Username,
+				Password:              config.Source.SFTP.Password,
+				PrivateKey:            config.Source.SFTP.PrivateKey,
+				PrivateKeyFile:        config.Source.SFTP.PrivateKeyFile,
+				PrivateKeyPassphrase:  config.Source.SFTP.PrivateKeyPassphrase,
+				KnownHostsFile:        config.Source.SFTP.KnownHostsFile,
+				InsecureIgnoreHostKey: config.Source.SFTP.InsecureIgnoreHostKey,
+				Location:              config.Source.SFTP.Location,
+				TempFileLocation:      config.TempFileLocation,
 			}
 
 			migrate.sourceStore = sourceStore
@@ -155,53 +255,99 @@ func New(config *config.Config, skipErrors bool) (*Migrate, error) {
 			return nil, errors.New("Invalid Source Type")
 		}
 
-		migrate.debugLog("Source store type set to: ", config.Source.Type)
+		migrate.debugf("Source store type set to: %s", config.Source.Type)
 	}
 
 	if config.Destination.Type != "" {
 
 		switch config.Destination.Type {
-		case "AmazonS3":
-			if config.Destination.AmazonS3.AccessID == "" || config.Destination.AmazonS3.AccessKey == "" || config.Destination.AmazonS3.Bucket == "" {
-				return nil, errors.New("Make sure you include all of the required options for AmazonS3")
+		case "GridFS":
+			if err := migrate.Connect(); err != nil {
+				return nil, err
 			}
 
-			destinationStore := &store.S3Provider{
-				Endpoint:  config.Destination.AmazonS3.Endpoint,
-				AccessID:  config.Destination.AmazonS3.AccessID,
-				AccessKey: config.Destination.AmazonS3.AccessKey,
-				Region:    config.Destination.AmazonS3.Region,
-				Bucket:    config.Destination.AmazonS3.Bucket,
-				UseSSL:    config.Destination.AmazonS3.UseSSL,
+			destinationStore := &store.GridFSProvider{
+				Database:       config.Database.Database,
+				Session:        migrate.session,
+				BucketNames:    config.Destination.GridFS.Buckets,
+				ChunkSizeBytes: config.Destination.GridFS.ChunkSize,
+				Buckets:        make(map[string]*gridfs.Bucket),
 			}
 
 			migrate.destinationStore = destinationStore
 
-		case "GoogleStorage":
-			if config.Destination.GoogleStorage.Bucket == "" || config.Destination.GoogleStorage.JSONKey == "" {
-				return nil, errors.New("Make sure you include all of the required options for AmazonS3")
+		case "AmazonS3":
+			destinationStore := &store.S3Provider{
+				Endpoint:             config.Destination.AmazonS3.Endpoint,
+				AccessID:             config.Destination.AmazonS3.AccessID,
+				AccessKey:            config.Destination.AmazonS3.AccessKey,
+				Region:               config.Destination.AmazonS3.Region,
+				Bucket:               config.Destination.AmazonS3.Bucket,
+				UseSSL:               config.Destination.AmazonS3.UseSSL,
+				ForcePathStyle:       config.Destination.AmazonS3.ForcePathStyle,
+				ServerSideEncryption: config.Destination.AmazonS3.ServerSideEncryption,
+				KMSKeyID:             config.Destination.AmazonS3.KMSKeyID,
+				StorageClass:         config.Destination.AmazonS3.StorageClass,
+				PartSize:             config.Destination.AmazonS3.PartSize,
+				UploadConcurrency:    config.Destination.AmazonS3.UploadConcurrency,
+				TagObjects:           config.Destination.AmazonS3.TagObjects,
 			}
 
+			migrate.destinationStore = destinationStore
+
+		case "GoogleStorage":
 			destinationStore := &store.GoogleStorageProvider{
-				JSONKey: config.Destination.GoogleStorage.JSONKey,
-				Bucket:  config.Destination.GoogleStorage.Bucket,
+				JSONKey:     config.Destination.GoogleStorage.JSONKey,
+				JSONKeyFile: config.Destination.GoogleStorage.JSONKeyFile,
+				Bucket:      config.Destination.GoogleStorage.Bucket,
+				ChunkSize:   config.Destination.GoogleStorage.ChunkSize,
 			}
 
 			migrate.destinationStore = destinationStore
-		case "FileSystem":
-			if config.Destination.FileSystem.Location == "" {
-				return nil, errors.New("Make sure you include all of the required options for FileSystem")
+		case "AzureBlobStorage":
+			destinationStore := &store.AzureBlobProvider{
+				AccountName:      config.Destination.AzureBlobStorage.AccountName,
+				AccountKey:       config.Destination.AzureBlobStorage.AccountKey,
+				ConnectionString: config.Destination.AzureBlobStorage.ConnectionString,
+				Endpoint:         config.Destination.AzureBlobStorage.Endpoint,
+				Container:        config.Destination.AzureBlobStorage.Container,
 			}
 
+			migrate.destinationStore = destinationStore
+		case "FileSystem":
 			if _, err := os.Stat(config.Destination.FileSystem.Location); os.IsNotExist(err) {
 				if err := os.MkdirAll(config.Destination.FileSystem.Location, 0777); err != nil {
-					migrate.debugLog(err)
+					migrate.debugf("%v", err)
 					return nil, errors.New("filesystem directory doesn't exist and unable to create it")
 				}
 			}
 
 			destinationStore := &store.FileSystemStorageProvider{
 				Location: config.Destination.FileSystem.Location,
+				Compress: config.Destination.FileSystem.Compress,
+			}
+
+			migrate.destinationStore = destinationStore
+		case "WebDAV":
+			destinationStore := &store.WebDAVProvider{
+				URL:      config.Destination.WebDAV.URL,
+				Username: config.Destination.WebDAV.Username,
+				Password: config.Destination.WebDAV.Password,
+			}
+
+			migrate.destinationStore = destinationStore
+		case "SFTP":
+			destinationStore := &store.SFTPProvider{
+				Host:                  config.Destination.SFTP.Host,
+				Port:                  config.Destination.SFTP.Port,
+				Username:              config.Destination.SFTP.Username,
+				Password:              config.Destination.SFTP.Password,
+				PrivateKey:            config.Destination.SFTP.PrivateKey,
+				PrivateKeyFile:        config.Destination.SFTP.PrivateKeyFile,
+				PrivateKeyPassphrase:  config.Destination.SFTP.PrivateKeyPassphrase,
+				KnownHostsFile:        config.Destination.SFTP.KnownHostsFile,
+				InsecureIgnoreHostKey: config.Destination.SFTP.InsecureIgnoreHostKey,
+				Location:              config.Destination.SFTP.Location,
 			}
 
 			migrate.destinationStore = destinationStore
@@ -209,7 +355,7 @@ func New(config *config.Config, skipErrors bool) (*Migrate, error) {
 			return nil, errors.New("Invalid Destination Type")
 		}
 
-		migrate.debugLog("Destination store type set to: ", config.Destination.Type)
+		migrate.debugf("Destination store type set to: %s", config.Destination.Type)
 
 	}
 
@@ -217,14 +363,113 @@ func New(config *config.Config, skipErrors bool) (*Migrate, error) {
 		return nil, errors.New("At least a source or destination store must be provided")
 	}
 
+	created = true
+
 	return migrate, nil
 }
 
+// NewFromConfig returns an initialized Migrate with everything, including skipErrors and concurrency, taken from cfg
+func NewFromConfig(cfg config.Config) (*Migrate, error) {
+	migrate, err := New(&cfg, cfg.SkipErrors)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxConcurrency > 0 {
+		if err := migrate.SetMaxConcurrency(cfg.MaxConcurrency); err != nil {
+			migrate.Close()
+			return nil, err
+		}
+	}
+
+	if cfg.DownloadConcurrency > 0 {
+		if err := migrate.SetDownloadConcurrency(cfg.DownloadConcurrency); err != nil {
+			migrate.Close()
+			return nil, err
+		}
+	}
+
+	if cfg.UploadConcurrency > 0 {
+		if err := migrate.SetUploadConcurrency(cfg.UploadConcurrency); err != nil {
+			migrate.Close()
+			return nil, err
+		}
+	}
+
+	if err := migrate.SetCursorBatchSize(cfg.CursorBatchSize); err != nil {
+		migrate.Close()
+		return nil, err
+	}
+
+	return migrate, nil
+}
+
+// Connect connects to the database. The connection is shared by all following operations until Close is called,
+// operations connect on their own if needed
+func (m *Migrate) Connect() error {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+
+	if m.session != nil {
+		return nil
+	}
+
+	session, err := connectDB(m.connectionString, m.databaseTLS)
+	if err != nil {
+		return err
+	}
+
+	m.session = session
+
+	// GridFS stores follow the connection when it is reopened after Close
+	for _, provider := range []store.Provider{m.sourceStore, m.destinationStore} {
+		if gridFS, ok := provider.(*store.GridFSProvider); ok {
+			gridFS.SetSession(session)
+		}
+	}
+
+	return nil
+}
+
+// Close releases the connections of the source and destination stores, ends the database session and disconnects
+// its client. A following operation connects again
+func (m *Migrate) Close() error {
+	var err error
+
+	for _, provider := range []store.Provider{m.sourceStore, m.destinationStore} {
+		if provider == nil {
+			continue
+		}
+
+		if closeErr := provider.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("unable to close %s: %w", provider.StoreType(), closeErr)
+		}
+	}
+
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+
+	if m.session == nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	m.session.EndSession(ctx)
+	if disconnectErr := m.session.Client().Disconnect(ctx); disconnectErr != nil && err == nil {
+		err = disconnectErr
+	}
+
+	m.session = nil
+
+	return err
+}
+
 var ErrNoJsonKey = errors.New("no-json-key")
 
 // GetRocketChatStore uses database to build source Store from settings
 func GetRocketChatStore(dbConfig config.DatabaseConfig) (*config.MigrateTarget, error) {
-	session, err := connectDB(dbConfig.ConnectionString)
+	session, err := connectDB(dbConfig.ConnectionString, dbConfig.TLS)
 	if err != nil {
 		return nil, err
 	}
@@ -235,7 +480,12 @@ func GetRocketChatStore(dbConfig config.DatabaseConfig) (*config.MigrateTarget,
 
 	db := client.Database(dbConfig.Database)
 
-	settingsCollection := db.Collection("rocketchat_settings")
+	settingsCollectionName := dbConfig.SettingsCollection
+	if settingsCollectionName == "" {
+		settingsCollectionName = defaultSettingsCollection
+	}
+
+	settingsCollection := db.Collection(settingsCollectionName)
 
 	var fileUploadStorageType rocketChatSetting
 
@@ -326,7 +576,43 @@ func GetRocketChatStore(dbConfig config.DatabaseConfig) (*config.MigrateTarget,
 	}
 }
 
-func connectDB(connectionstring string) (mongo.Session, error) {
+// databaseTLSConfig builds the TLS configuration for the database, nil when none of it is set
+func databaseTLSConfig(settings config.DatabaseTLSConfig) (*tls.Config, error) {
+	if settings.CAFile == "" && settings.CertFile == "" && settings.KeyFile == "" && !settings.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: settings.InsecureSkipVerify,
+	}
+
+	if settings.CAFile != "" {
+		ca, err := ioutil.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in CA file " + settings.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if settings.CertFile != "" || settings.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func connectDB(connectionstring string, tlsSettings config.DatabaseTLSConfig) (mongo.Session, error) {
 
 	secondaryPreferred := false
 
@@ -347,9 +633,29 @@ func connectDB(connectionstring string) (mongo.Session, error) {
 		secondaryPreferred = true
 	}
 
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(connectionstring))
+	clientOpts := options.Client().ApplyURI(connectionstring)
+
+	// Retry a failed operation once after a failover, unless the connection string says otherwise
+	if clientOpts.RetryWrites == nil {
+		clientOpts.SetRetryWrites(true)
+	}
+
+	if clientOpts.RetryReads == nil {
+		clientOpts.SetRetryReads(true)
+	}
+
+	tlsConfig, err := databaseTLSConfig(tlsSettings)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	if tlsConfig != nil {
+		clientOpts.SetTLSConfig(tlsConfig)
+	}
+
+	client, err := mongo.Connect(context.Background(), clientOpts)
+	if err != nil {
+		return nil, err
 	}
 
 	var sessionOpts *options.SessionOptions = nil
@@ -0,0 +1,49 @@
+package migrator
+
+import "testing"
+
+func TestConnectReusesSession(t *testing.T) {
+	// The driver connects lazily, so no server has to listen on the address
+	m := &Migrate{connectionString: "mongodb://127.0.0.1:1/rocketchat"}
+
+	if err := m.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+
+	session := m.session
+	if session == nil {
+		t.Fatal("Connect() didn't open a session")
+	}
+
+	if err := m.Connect(); err != nil {
+		t.Fatalf("second Connect() error = %v", err)
+	}
+
+	if m.session != session {
+		t.Error("second Connect() opened a new session instead of reusing the client")
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if m.session != nil {
+		t.Error("Close() kept the session")
+	}
+
+	if err := m.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+
+	if err := m.Connect(); err != nil {
+		t.Fatalf("Connect() after Close() error = %v", err)
+	}
+
+	if m.session == nil || m.session == session {
+		t.Error("Connect() after Close() didn't open a new session")
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+}
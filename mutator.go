@@ -0,0 +1,38 @@
+package migrator
+
+import "github.com/RocketChat/filestore-migrator/rocketchat"
+
+// SetDocumentMutator registers a function that can adjust each file document right before it is written to the database,
+// ie. to drop a legacy field or tag migrated files. Descriptive fields like Name, Description, Type, Rid, UserID or
+// Identify are safe to change. The fields Rocket.Chat locates the file by, ID, Store, Path, URL and the store sub documents
+// AmazonS3, GoogleStorage, AzureBlobStorage, WebDAV and SFTP, are restored after the mutator ran, as are the previous
+// location fields kept by SetPreserveOriginalStore.
+// With concurrency enabled the mutator is called from multiple goroutines
+func (m *Migrate) SetDocumentMutator(mutator func(*rocketchat.File)) {
+	m.documentMutator = mutator
+}
+
+// mutateDocument runs the document mutator on file, keeping the fields the file is found by
+func (m *Migrate) mutateDocument(file *rocketchat.File) {
+	if m.documentMutator == nil {
+		return
+	}
+
+	protected := *file
+
+	m.documentMutator(file)
+
+	file.ID = protected.ID
+	file.Store = protected.Store
+	file.Path = protected.Path
+	file.URL = protected.URL
+	file.AmazonS3 = protected.AmazonS3
+	file.GoogleStorage = protected.GoogleStorage
+	file.AzureBlobStorage = protected.AzureBlobStorage
+	file.WebDAV = protected.WebDAV
+	file.SFTP = protected.SFTP
+	file.PreviousStore = protected.PreviousStore
+	file.PreviousPath = protected.PreviousPath
+	file.PreviousURL = protected.PreviousURL
+	file.PreviousReference = protected.PreviousReference
+}
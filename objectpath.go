@@ -0,0 +1,112 @@
+package migrator
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+)
+
+// ObjectPathData is what an object path template is rendered with.
+// Name is the file name made safe for a single path element, the document keeps the original name
+type ObjectPathData struct {
+	UniqueID  string
+	StoreName string
+	Rid       string
+	UserID    string
+	Username  string
+	ID        string
+	Name      string
+}
+
+// SetObjectPathTemplate sets a text/template used to build the object path of each file in the destination store,
+// ie. "{{.UniqueID}}/{{.StoreName}}/{{.ID}}". An empty template restores the default layouts.
+// GridFS destinations always key files by ID and ignore the template.
+// FileSystem destinations do follow it, moving files away from <location>/<file id> where Rocket.Chat reads them by default
+func (m *Migrate) SetObjectPathTemplate(tmpl string) error {
+	if tmpl == "" {
+		m.objectPathTemplate = nil
+		return nil
+	}
+
+	t, err := template.New("objectPath").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return err
+	}
+
+	// Catch references to unknown fields now rather than on the first file
+	if err := t.Execute(&bytes.Buffer{}, ObjectPathData{}); err != nil {
+		return err
+	}
+
+	m.objectPathTemplate = t
+
+	return nil
+}
+
+func (m *Migrate) renderObjectPath(file *rocketchat.File) (string, error) {
+	var buf bytes.Buffer
+
+	if err := m.objectPathTemplate.Execute(&buf, ObjectPathData{
+		UniqueID:  m.uniqueID,
+		StoreName: strings.ToLower(m.storeName),
+		Rid:       file.Rid,
+		UserID:    file.UserID,
+		Username:  file.Username,
+		ID:        file.ID,
+		Name:      objectKeyName(file.Name),
+	}); err != nil {
+		return "", err
+	}
+
+	objectPath := strings.TrimPrefix(buf.String(), "/")
+	if objectPath == "" {
+		return "", errors.New("object path template rendered an empty path for file " + file.ID)
+	}
+
+	return objectPath, nil
+}
+
+// SetDestinationPrefix places the objects of bucket and container destinations below prefix, ie. "rocketchat" for
+// rocketchat/<unique id>/uploads/... The prefix is part of the path written to the documents so Rocket.Chat finds the files.
+// FileSystem and GridFS destinations don't use it
+func (m *Migrate) SetDestinationPrefix(prefix string) {
+	m.destinationPrefix = strings.Trim(path.Clean("/"+prefix), "/")
+}
+
+func (m *Migrate) withDestinationPrefix(objectPath string) string {
+	if m.destinationPrefix == "" {
+		return objectPath
+	}
+
+	return m.destinationPrefix + "/" + objectPath
+}
+
+// objectKeyName replaces the characters of a file name that would nest the object below further prefixes, or that stores
+// and URLs handle poorly, ie. / \ # ? and control characters. The names . and .. become an underscore
+func objectKeyName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == '#' || r == '?' || r == unicode.ReplacementChar || unicode.IsControl(r) {
+			return '_'
+		}
+
+		return r
+	}, name)
+
+	if name == "." || name == ".." {
+		return "_"
+	}
+
+	return name
+}
+
+// ufsFileName is the file name as it is written to the ufs path and url of a document. It is escaped so slashes, #
+// and other special characters in the name don't change the route Rocket.Chat resolves
+func ufsFileName(name string) string {
+	return url.PathEscape(name)
+}
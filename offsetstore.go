@@ -0,0 +1,198 @@
+package migrator
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SetOffsetStore sets a JSON file where the upload date of the newest migrated file is kept for every store name.
+// Without an explicit offset the next run only looks at files uploaded from that date on,
+// so repeated runs pick up the newly uploaded files only
+func (m *Migrate) SetOffsetStore(path string) {
+	m.offsetStoreFile = path
+}
+
+// loadOffsets reads the offsets of all store names, a missing file means no store was migrated yet
+func loadOffsets(path string) (map[string]time.Time, error) {
+	offsets := make(map[string]time.Time)
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return offsets, nil
+		}
+
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &offsets); err != nil {
+		return nil, err
+	}
+
+	return offsets, nil
+}
+
+// applyStoredOffset makes query start at the stored offset of the store when no offset was set explicitly
+func (m *Migrate) applyStoredOffset(query bson.M) error {
+	if m.offsetStoreFile == "" || !m.fileOffset.IsZero() {
+		return nil
+	}
+
+	offsets, err := loadOffsets(m.offsetStoreFile)
+	if err != nil {
+		return err
+	}
+
+	offset, ok := offsets[m.storeName]
+	if !ok || offset.IsZero() {
+		return nil
+	}
+
+	m.infof("Resuming %s from the stored offset %s", m.storeName, offset.Format(time.RFC3339))
+
+	uploadedAt, ok := query["uploadedAt"].(bson.M)
+	if !ok {
+		uploadedAt = bson.M{}
+	}
+
+	uploadedAt["$gte"] = offset
+	query["uploadedAt"] = uploadedAt
+
+	return nil
+}
+
+// offsetWatermark follows the files of a run, which are sorted by upload date, and holds the upload date of the last file
+// that is done with all files before it done too. Failed files and files still being uploaded to Rocket.Chat hold
+// the watermark back so they are picked up again. Only the files after the watermark are kept
+type offsetWatermark struct {
+	mu      sync.Mutex
+	pending []watermarkEntry
+	base    int
+	reached time.Time
+}
+
+type watermarkEntry struct {
+	uploadedAt time.Time
+	done       bool
+}
+
+// track adds the file at the 1 based index, files have to be tracked in order before they finish
+func (w *offsetWatermark) track(index int, file rocketchat.File) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if index != w.base+len(w.pending)+1 {
+		return
+	}
+
+	w.pending = append(w.pending, watermarkEntry{uploadedAt: file.UploadedAt})
+}
+
+// finish marks the file at the 1 based index as done, unless it was skipped for not being complete yet
+func (w *offsetWatermark) finish(index int, err error) {
+	if errors.Is(err, ErrFileIncomplete) {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	position := index - 1 - w.base
+	if position < 0 || position >= len(w.pending) {
+		return
+	}
+
+	w.pending[position].done = true
+
+	for len(w.pending) > 0 && w.pending[0].done {
+		w.reached = w.pending[0].uploadedAt
+		w.pending = w.pending[1:]
+		w.base++
+	}
+}
+
+// offset returns the upload date of the last file done without gaps, zero when there is none
+func (w *offsetWatermark) offset() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.reached
+}
+
+// startOffsetTracking follows the files of the run when an offset store is set, the returned function stores the reached offset
+func (m *Migrate) startOffsetTracking() func() error {
+	if m.offsetStoreFile == "" {
+		return func() error { return nil }
+	}
+
+	m.offsets = &offsetWatermark{}
+
+	return func() error {
+		watermark := m.offsets
+		m.offsets = nil
+
+		if m.dryRun {
+			return nil
+		}
+
+		return m.storeOffset(watermark.offset())
+	}
+}
+
+// storeOffset saves offset for the current store name, an earlier offset than the stored one is ignored
+func (m *Migrate) storeOffset(offset time.Time) error {
+	if offset.IsZero() {
+		return nil
+	}
+
+	offsets, err := loadOffsets(m.offsetStoreFile)
+	if err != nil {
+		return err
+	}
+
+	if offset.Before(offsets[m.storeName]) {
+		return nil
+	}
+
+	offsets[m.storeName] = offset
+
+	content, err := json.MarshalIndent(offsets, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Replace the file at once, a crash while writing must not lose the offsets of the other stores
+	tmp, err := ioutil.TempFile(filepath.Dir(m.offsetStoreFile), filepath.Base(m.offsetStoreFile)+".*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), m.offsetStoreFile); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	m.debugf("Stored offset %s for %s", offset.Format(time.RFC3339), m.storeName)
+
+	return nil
+}
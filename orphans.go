@@ -0,0 +1,206 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"github.com/RocketChat/filestore-migrator/store"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// FindOrphans returns the paths of the objects in the destination store, below the paths the current store is migrated to,
+// that no file document points at. These are usually left behind by interrupted or repeated migrations.
+// Every registered store is taken into account, as stores may share a FileSystem location or a destination prefix
+func (m *Migrate) FindOrphans() ([]string, error) {
+	return m.FindOrphansContext(context.Background())
+}
+
+// FindOrphansContext finds orphaned objects like FindOrphans
+func (m *Migrate) FindOrphansContext(ctx context.Context) ([]string, error) {
+	if m.destinationStore == nil {
+		return nil, errors.New("For FindOrphans must have a destination store provided")
+	}
+
+	return m.findOrphans(ctx, m.destinationStore)
+}
+
+// PurgeOrphans removes the objects in the source store that no file document in the source store points at,
+// ie. the GridFS chunks of files that were migrated but never deleted. With dryRun the orphans are only returned.
+// Files migrated to the destination count as orphans of the source, so only purge once the migration is verified
+func (m *Migrate) PurgeOrphans(dryRun bool) ([]string, error) {
+	return m.PurgeOrphansContext(context.Background(), dryRun)
+}
+
+// PurgeOrphansContext removes orphaned source objects like PurgeOrphans. Cancelling ctx stops before the next object
+func (m *Migrate) PurgeOrphansContext(ctx context.Context, dryRun bool) ([]string, error) {
+	if m.sourceStore == nil {
+		return nil, errors.New("For PurgeOrphans must have a source store provided")
+	}
+
+	orphans, err := m.findOrphans(ctx, m.sourceStore)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		for _, objectPath := range orphans {
+			m.infof("Dry run: would remove %s from %s", objectPath, m.sourceStore.StoreType())
+		}
+
+		return orphans, nil
+	}
+
+	var removed []string
+
+	for index, objectPath := range orphans {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+
+		m.debugf("[%v/%v] Removing %s from %s", index+1, len(orphans), objectPath, m.sourceStore.StoreType())
+
+		if err := m.withRetry(ctx, "Removal of "+objectPath, func() error {
+			return m.sourceStore.DeleteObject(objectPath)
+		}); err != nil {
+			return removed, err
+		}
+
+		removed = append(removed, objectPath)
+	}
+
+	m.infof("Removed %d orphaned objects from %s", len(removed), m.sourceStore.StoreType())
+
+	return removed, nil
+}
+
+// findOrphans lists the objects of provider the current store may have and returns the ones no document accounts for
+func (m *Migrate) findOrphans(ctx context.Context, provider store.Provider) ([]string, error) {
+	if m.storeName == "" {
+		return nil, errors.New("no store Name")
+	}
+
+	expected, err := m.expectedObjectPaths(ctx, provider)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := m.orphanListPrefix(provider)
+
+	listed, err := provider.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+
+	for _, objectPath := range listed {
+		if _, ok := expected[objectPath]; !ok {
+			orphans = append(orphans, objectPath)
+		}
+	}
+
+	m.infof("Found %d orphaned objects of %d in %s below %q", len(orphans), len(listed), provider.StoreType(), prefix)
+
+	return orphans, nil
+}
+
+// orphanListPrefix returns the part of provider the current store's files are in.
+// Templated layouts can put files anywhere below the destination prefix
+func (m *Migrate) orphanListPrefix(provider store.Provider) string {
+	switch provider.StoreType() {
+	case "FileSystem":
+		return ""
+	case "GridFS":
+		collection, _ := m.storeCollection(m.storeName)
+		return collection + "/"
+	}
+
+	if provider != m.destinationStore {
+		// Rocket.Chat's own layout
+		return m.uniqueID + "/" + strings.ToLower(m.storeName) + "/"
+	}
+
+	if m.objectPathTemplate != nil {
+		if m.destinationPrefix == "" {
+			return ""
+		}
+
+		return m.destinationPrefix + "/"
+	}
+
+	return m.withDestinationPrefix(m.uniqueID + "/" + strings.ToLower(m.storeName) + "/")
+}
+
+// expectedObjectPaths collects the paths of every file document of every registered store that is in provider,
+// both the path it was written with and, for the destination, the path it would be migrated to now.
+// The store name set before is restored
+func (m *Migrate) expectedObjectPaths(ctx context.Context, provider store.Provider) (map[string]struct{}, error) {
+	previousStoreName := m.storeName
+	previousCollection := m.fileCollectionName
+	defer func() {
+		m.storeName = previousStoreName
+		m.fileCollectionName = previousCollection
+	}()
+
+	expected := make(map[string]struct{})
+
+	for _, storeName := range m.storeNames() {
+		m.storeName = storeName
+
+		query := bson.M{"store": provider.StoreType() + ":" + storeName}
+
+		// Every document counts, not only the ones the date, size and limit filters select for migrating
+		files, err := m.findFilesWithOptions(ctx, query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			if referencePath := storeReferencePath(provider.StoreType(), file); referencePath != "" {
+				expected[referencePath] = struct{}{}
+			}
+
+			switch provider.StoreType() {
+			case "FileSystem":
+				expected[file.ID] = struct{}{}
+			case "GridFS":
+				expected[m.fileCollectionName+"/"+file.ID] = struct{}{}
+			}
+
+			if provider != m.destinationStore {
+				continue
+			}
+
+			m.fillFileDefaults(&file)
+
+			objectPath, err := m.getObjectPath(&file)
+			if err != nil {
+				return nil, err
+			}
+
+			expected[objectPath] = struct{}{}
+		}
+	}
+
+	return expected, nil
+}
+
+// storeReferencePath returns the path the document records for its object in a store of storeType
+func storeReferencePath(storeType string, file rocketchat.File) string {
+	switch storeType {
+	case "AmazonS3":
+		return file.AmazonS3.Path
+	case "GoogleCloudStorage":
+		return file.GoogleStorage.Path
+	case "AzureBlobStorage":
+		return file.AzureBlobStorage.Path
+	case "WebDAV":
+		return file.WebDAV.Path
+	case "SFTP":
+		return file.SFTP.Path
+	}
+
+	return ""
+}
@@ -0,0 +1,178 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"github.com/RocketChat/filestore-migrator/store"
+)
+
+// preflightContent is written to the probe object of the destination store
+const preflightContent = "filestore-migrator preflight"
+
+// PreflightError is returned by Preflight, Check names what failed: database, source or destination
+type PreflightError struct {
+	Check string
+	Err   error
+}
+
+func (e *PreflightError) Error() string {
+	return "preflight " + e.Check + " check failed: " + e.Err.Error()
+}
+
+// Unwrap returns the error of the failed check
+func (e *PreflightError) Unwrap() error {
+	return e.Err
+}
+
+// Preflight checks that everything a migration needs is reachable before starting one. The database is pinged,
+// the oldest file of the store is opened in the source store and a tiny probe object is written, read back
+// and removed in the destination store. The first failing check is returned as a *PreflightError
+func (m *Migrate) Preflight() error {
+	return m.PreflightContext(context.Background())
+}
+
+// PreflightContext runs the checks of Preflight
+func (m *Migrate) PreflightContext(ctx context.Context) error {
+	if err := m.Connect(); err != nil {
+		return &PreflightError{Check: "database", Err: err}
+	}
+
+	if err := m.session.Client().Ping(ctx, nil); err != nil {
+		return &PreflightError{Check: "database", Err: err}
+	}
+
+	m.infof("Preflight: database is reachable")
+
+	if m.sourceStore != nil && m.storeName != "" {
+		if err := m.preflightSource(ctx); err != nil {
+			return &PreflightError{Check: "source", Err: err}
+		}
+	}
+
+	if m.destinationStore != nil {
+		if err := m.preflightDestination(); err != nil {
+			return &PreflightError{Check: "destination", Err: err}
+		}
+	}
+
+	return nil
+}
+
+// preflightSource reads the oldest file of the store from the source store. A missing file is only logged,
+// it says nothing about the access to the store
+func (m *Migrate) preflightSource(ctx context.Context) error {
+	files, err := m.findFilesWithOptions(ctx, m.fileQuery(), m.findOptions().SetLimit(1))
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		m.infof("Preflight: no files of %s in %s to read, skipping the source check", m.storeName, m.sourceStore.StoreType())
+		return nil
+	}
+
+	file := files[0]
+
+	err = m.readSourceFile(file)
+	if errors.Is(err, store.ErrNotFound) {
+		m.infof("Preflight: %s is missing from %s, the store itself is accessible", file.Name, m.sourceStore.StoreType())
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	m.infof("Preflight: %s is readable", m.sourceStore.StoreType())
+
+	return nil
+}
+
+// readSourceFile reads the first byte of the file from stores that can open files, the others are asked for its object
+func (m *Migrate) readSourceFile(file rocketchat.File) error {
+	if opener, ok := m.sourceStore.(store.Opener); ok {
+		reader, _, err := opener.Open(m.fileCollectionName, file)
+		if err != nil {
+			return err
+		}
+
+		defer reader.Close()
+
+		if _, err := reader.Read(make([]byte, 1)); err != nil && err != io.EOF {
+			return err
+		}
+
+		return nil
+	}
+
+	objectPath := storeReferencePath(m.sourceStore.StoreType(), file)
+	if objectPath == "" {
+		m.infof("Preflight: %s has no path to check, skipping the source check", file.Name)
+		return nil
+	}
+
+	_, err := m.sourceStore.Stat(objectPath)
+
+	return err
+}
+
+// preflightDestination writes, stats and removes a probe object in the destination store
+func (m *Migrate) preflightDestination() error {
+	probeName := "filestore-migrator-preflight-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	objectPath := m.withDestinationPrefix(probeName)
+	if m.destinationStore.StoreType() == "GridFS" {
+		collection, ok := m.storeCollection(m.storeName)
+		if !ok {
+			collection, _ = m.storeCollection("Uploads")
+		}
+
+		objectPath = collection + "/" + probeName
+	}
+
+	probe, err := ioutil.TempFile(m.tempFileLocation, probeName)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(probe.Name())
+
+	_, err = probe.WriteString(preflightContent)
+	if closeErr := probe.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := m.destinationStore.Upload(objectPath, probe.Name(), "text/plain"); err != nil {
+		return fmt.Errorf("unable to write %s: %w", objectPath, err)
+	}
+
+	info, err := m.destinationStore.Stat(objectPath)
+	if err == nil && info.Size != int64(len(preflightContent)) {
+		err = fmt.Errorf("size is %d instead of %d", info.Size, len(preflightContent))
+	}
+
+	if err != nil {
+		m.destinationStore.DeleteObject(objectPath)
+		return fmt.Errorf("unable to read back %s: %w", objectPath, err)
+	}
+
+	if err := m.destinationStore.DeleteObject(objectPath); err != nil {
+		return fmt.Errorf("unable to remove %s: %w", objectPath, err)
+	}
+
+	m.infof("Preflight: %s is writable", m.destinationStore.StoreType())
+
+	return nil
+}
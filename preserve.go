@@ -0,0 +1,127 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SetPreserveOriginalStore keeps the store, path, url and store sub document a file had before it was migrated
+// in the previousStore, previousPath, previousUrl and previousReference fields of its document, written along with
+// the update that points it at the destination. RevertStore uses them to point the files back
+func (m *Migrate) SetPreserveOriginalStore(preserve bool) {
+	m.preserveOriginalStore = preserve
+}
+
+// preserveOriginalStore copies the current location of the file into its previous fields
+func preserveOriginalStore(file *rocketchat.File) {
+	storeType := file.Store
+	if i := strings.Index(storeType, ":"); i >= 0 {
+		storeType = storeType[:i]
+	}
+
+	file.PreviousStore = file.Store
+	file.PreviousPath = file.Path
+	file.PreviousURL = file.URL
+	file.PreviousReference = rocketchat.StoreReference{}
+
+	if reference := storeReferenceNames[storeType]; reference != "" {
+		file.PreviousReference = rocketchat.StoreReference{Name: reference, Path: referencePath(reference, *file)}
+	}
+}
+
+// RevertStore points the files kept with SetPreserveOriginalStore back at the store they were migrated from,
+// restoring their store, path, url and store sub document and dropping the reference to the destination.
+// No bytes are moved, the objects are expected to still be in the original store, ie. when the source wasn't deleted
+func (m *Migrate) RevertStore() error {
+	return m.RevertStoreContext(context.Background())
+}
+
+// RevertStoreContext reverts the documents like RevertStore.
+// Once ctx is cancelled no further files are reverted and ctx.Err() is returned
+func (m *Migrate) RevertStoreContext(ctx context.Context) error {
+	if m.storeName == "" {
+		return errors.New("no store Name")
+	}
+
+	files, err := m.findFiles(ctx, bson.M{"previousStore": bson.M{"$exists": true, "$ne": ""}})
+	if err != nil {
+		return err
+	}
+
+	m.debugf("Found %v files to revert", len(files))
+
+	result := &MigrationResult{Store: m.storeName, Total: len(files)}
+
+	m.result = result
+	defer func() { m.result = nil }()
+
+	atomic.StoreInt64(&m.dryRunCount, 0)
+
+	start := time.Now()
+
+	err = m.forEachFile(ctx, files, m.revertFile)
+
+	if flushErr := m.flushUpdates(context.Background()); err == nil {
+		err = flushErr
+	}
+
+	result.finish(start)
+
+	if err != nil {
+		return err
+	}
+
+	if m.dryRun {
+		m.infof("Dry run: %v of %v files would have been reverted", atomic.LoadInt64(&m.dryRunCount), len(files))
+	} else {
+		m.infof("Reverted %d of %d files of %s to their previous store", result.Migrated, result.Total, m.storeName)
+	}
+
+	return nil
+}
+
+// revertFile points the document of a single file back at its previous store
+func (m *Migrate) revertFile(ctx context.Context, index int, total int, file rocketchat.File) error {
+	if m.dryRun {
+		m.infof("[%v/%v] Dry run: would revert %s from %s to %s", index, total, file.Name, file.Store, file.PreviousStore)
+		atomic.AddInt64(&m.dryRunCount, 1)
+
+		return nil
+	}
+
+	set := bson.M{
+		"store": file.PreviousStore,
+		"path":  file.PreviousPath,
+		"url":   file.PreviousURL,
+	}
+
+	unset := bson.M{
+		"previousStore":     1,
+		"previousPath":      1,
+		"previousUrl":       1,
+		"previousReference": 1,
+	}
+
+	// The original sub document is restored, the one pointing at the destination has to go
+	for _, reference := range storeReferences {
+		if reference == file.PreviousReference.Name {
+			set[reference] = bson.M{"path": file.PreviousReference.Path}
+			continue
+		}
+
+		unset[reference] = 1
+	}
+
+	return m.updateFile(ctx, pendingUpdate{
+		file:   file,
+		update: bson.M{"$set": set, "$unset": unset},
+		index:  index,
+		total:  total,
+	})
+}
@@ -0,0 +1,91 @@
+package migrator
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+)
+
+// ErrFileIncomplete is the reason given for files skipped because they never finished uploading to Rocket.Chat
+var ErrFileIncomplete = errors.New("file wasn't completed uploading")
+
+// ProgressPhase is the step a file is in when a ProgressEvent is emitted
+type ProgressPhase string
+
+const (
+	// PhaseDownloading is emitted before a file is fetched from the source store
+	PhaseDownloading ProgressPhase = "downloading"
+	// PhaseUploading is emitted before a file is sent to the destination store
+	PhaseUploading ProgressPhase = "uploading"
+	// PhaseUpdating is emitted before the file document is pointed at the destination store
+	PhaseUpdating ProgressPhase = "updating"
+	// PhaseSkipped is emitted when a file is not processed, Err holds the reason
+	PhaseSkipped ProgressPhase = "skipped"
+	// PhaseCompleted is emitted once a file has been fully processed
+	PhaseCompleted ProgressPhase = "completed"
+)
+
+// ProgressEvent describes a file changing phase. Err is set when the phase failed or the file was skipped.
+// Index is the position the file was scheduled at, Completed counts the files finished so far in the run,
+// including this one, and is only set once the file is done
+type ProgressEvent struct {
+	FileID    string
+	FileName  string
+	Index     int
+	Total     int
+	Completed int
+	Phase     ProgressPhase
+	Err       error
+}
+
+// SetProgressHandler registers a handler that is called every time a file changes phase.
+// With concurrency enabled the handler is called from multiple goroutines
+func (m *Migrate) SetProgressHandler(handler func(ProgressEvent)) {
+	m.progressHandler = handler
+}
+
+func (m *Migrate) progress(file rocketchat.File, index int, total int, phase ProgressPhase, err error) {
+	event := ProgressEvent{
+		FileID:   file.ID,
+		FileName: file.Name,
+		Index:    index,
+		Total:    total,
+		Phase:    phase,
+		Err:      err,
+	}
+
+	if phase == PhaseCompleted || phase == PhaseSkipped || err != nil {
+		event.Completed = int(atomic.AddInt64(&m.completed, 1))
+
+		if err != nil && phase != PhaseSkipped {
+			m.debugf("[%v/%v] %s failed while %s: %v", event.Completed, total, file.Name, phase, err)
+		} else {
+			m.debugf("[%v/%v] %s %s", event.Completed, total, file.Name, phase)
+		}
+	}
+
+	if m.result != nil {
+		m.result.record(event)
+	}
+
+	if m.report != nil {
+		m.reportEvent(file, event)
+	}
+
+	m.observeFile(file, event)
+
+	if m.offsets != nil && (phase == PhaseCompleted || phase == PhaseSkipped) {
+		m.offsets.finish(index, err)
+	}
+
+	if m.checkpoint != nil && phase == PhaseCompleted {
+		if err := m.checkpoint.add(file.ID); err != nil {
+			m.errorf("unable to add %s to checkpoint: %v", file.ID, err)
+		}
+	}
+
+	if m.progressHandler != nil {
+		m.progressHandler(event)
+	}
+}
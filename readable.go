@@ -0,0 +1,63 @@
+package migrator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+)
+
+// SetReadableDownloads makes DownloadAll lay files out as <rid>/<name> below the store's temp directory instead of <file id>,
+// so the files can be browsed as an offline backup. A name that is taken gets the file id appended.
+// UploadAll finds files by id, so it can't upload from a readable download
+func (m *Migrate) SetReadableDownloads(readable bool) {
+	m.readableDownloads = readable
+}
+
+// moveToReadablePath moves a downloaded file from its id based path to <rid>/<name> and returns the new path
+func (m *Migrate) moveToReadablePath(downloadedPath string, file rocketchat.File) (string, error) {
+	dir := safePathElement(file.Rid)
+	if dir == "" {
+		dir = safePathElement(file.UserID)
+	}
+
+	name := safePathElement(file.Name)
+	if name == "" {
+		name = file.ID
+	}
+
+	dir = filepath.Join(m.storeTempDirectory(), dir)
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+
+	// Picking a free name and taking it has to happen at once with concurrent downloads
+	m.readableMu.Lock()
+	defer m.readableMu.Unlock()
+
+	target := filepath.Join(dir, name)
+
+	if _, err := os.Stat(target); err == nil {
+		ext := filepath.Ext(name)
+		target = filepath.Join(dir, strings.TrimSuffix(name, ext)+"-"+file.ID+ext)
+	}
+
+	if err := os.Rename(downloadedPath, target); err != nil {
+		return "", err
+	}
+
+	return target, nil
+}
+
+// safePathElement turns a document value into a single path element, it is empty when nothing usable is left
+func safePathElement(value string) string {
+	value = filepath.Base(strings.Replace(value, "\\", "/", -1))
+
+	if value == "." || value == ".." || value == "/" {
+		return ""
+	}
+
+	return value
+}
@@ -0,0 +1,133 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"github.com/RocketChat/filestore-migrator/store"
+)
+
+// RepointStore points the documents of the store's files at the destination store without copying any bytes,
+// for files that were already copied by other means, ie. aws s3 sync. Objects are expected where MigrateStore
+// would have put them. With SetVerifyChecksum every object is looked up first, missing objects are skipped
+// and objects of the wrong size fail the file
+func (m *Migrate) RepointStore() error {
+	return m.RepointStoreContext(context.Background())
+}
+
+// RepointStoreContext repoints the documents like RepointStore.
+// Once ctx is cancelled no further files are repointed and ctx.Err() is returned
+func (m *Migrate) RepointStoreContext(ctx context.Context) error {
+	if m.sourceStore == nil || m.destinationStore == nil {
+		return errors.New("For RepointStore must have a source and destination store provided")
+	}
+
+	if err := m.checkCompressedDestination(); err != nil {
+		return err
+	}
+
+	files, err := m.getFiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.debugf("Found %v files", len(files))
+
+	closeCheckpoint, err := m.openCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	defer closeCheckpoint()
+
+	result := &MigrationResult{Store: m.storeName, Total: len(files), AlreadyMigrated: m.countAlreadyMigrated(ctx)}
+
+	m.result = result
+	defer func() { m.result = nil }()
+
+	atomic.StoreInt64(&m.dryRunCount, 0)
+
+	start := time.Now()
+
+	err = m.forEachFile(ctx, files, m.repointFile)
+
+	if flushErr := m.flushUpdates(context.Background()); err == nil {
+		err = flushErr
+	}
+
+	result.finish(start)
+
+	if err != nil {
+		return err
+	}
+
+	if m.dryRun {
+		m.infof("Dry run: %v of %v files would have been repointed", atomic.LoadInt64(&m.dryRunCount), len(files))
+	} else {
+		m.infof("Repointed %d of %d files to %s", result.Migrated, result.Total, m.destinationStore.StoreType())
+	}
+
+	return nil
+}
+
+// repointFile points the document of a single file at its object in the destination store
+func (m *Migrate) repointFile(ctx context.Context, index int, total int, file rocketchat.File) error {
+	if !file.Complete {
+		m.debugf("[%v/%v] File wasn't completed uploading for %s Skipping", index, total, file.Name)
+		m.progress(file, index, total, PhaseSkipped, ErrFileIncomplete)
+
+		return nil
+	}
+
+	m.fillFileDefaults(&file)
+
+	objectPath, err := m.getObjectPath(&file)
+	if err != nil {
+		m.progress(file, index, total, PhaseUpdating, err)
+		return err
+	}
+
+	if m.dryRun {
+		m.infof("[%v/%v] Dry run: would repoint %s to %s: %s", index, total, file.Name, m.destinationStore.StoreType(), objectPath)
+		atomic.AddInt64(&m.dryRunCount, 1)
+
+		return nil
+	}
+
+	if m.verifyChecksum {
+		var stored store.FileInfo
+
+		err := m.withRetry(ctx, "Stat of "+file.Name, func() (err error) {
+			stored, err = m.destinationStore.Stat(objectPath)
+			return err
+		})
+		if errors.Is(err, store.ErrNotFound) {
+			m.infof("[%v/%v] %s is missing from %s at %s, not repointing it", index, total, file.Name, m.destinationStore.StoreType(), objectPath)
+			m.progress(file, index, total, PhaseSkipped, err)
+
+			return nil
+		}
+
+		if err == nil && file.Size > 0 && stored.Size != int64(file.Size) {
+			err = fmt.Errorf("%w: %s has %d bytes in %s, expected %d", ErrVerificationFailed, file.ID, stored.Size, m.destinationStore.StoreType(), file.Size)
+		}
+
+		if err != nil {
+			m.progress(file, index, total, PhaseUpdating, err)
+			return err
+		}
+	}
+
+	unset := m.fixFileForUpload(&file, objectPath)
+
+	return m.updateFile(ctx, pendingUpdate{
+		file:   file,
+		update: fileUpdate(file, unset),
+		index:  index,
+		total:  total,
+	})
+}
@@ -0,0 +1,113 @@
+package migrator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+)
+
+// migrationReport is the JSON document written to the report file after MigrateStore
+type migrationReport struct {
+	Store            string         `json:"store"`
+	SourceStore      string         `json:"sourceStore"`
+	DestinationStore string         `json:"destinationStore"`
+	StartedAt        time.Time      `json:"startedAt"`
+	FinishedAt       time.Time      `json:"finishedAt"`
+	Error            string         `json:"error,omitempty"`
+	Counts           reportCounts   `json:"counts"`
+	Files            []reportRecord `json:"files"`
+
+	mu sync.Mutex
+}
+
+type reportCounts struct {
+	Total             int `json:"total"`
+	Migrated          int `json:"migrated"`
+	AlreadyMigrated   int `json:"alreadyMigrated"`
+	SkippedIncomplete int `json:"skippedIncomplete"`
+	SkippedMissing    int `json:"skippedMissing"`
+	Failed            int `json:"failed"`
+}
+
+// reportRecord is the outcome of a single file
+type reportRecord struct {
+	ID               string `json:"id"`
+	Name             string `json:"name"`
+	SourceStore      string `json:"sourceStore"`
+	DestinationStore string `json:"destinationStore"`
+	ObjectPath       string `json:"objectPath,omitempty"`
+	Status           string `json:"status"`
+	Error            string `json:"error,omitempty"`
+}
+
+// SetReportFile sets a file the outcome of every MigrateStore run is written to as JSON, failed runs included
+func (m *Migrate) SetReportFile(path string) {
+	m.reportFile = path
+}
+
+// reportEvent adds the final outcome of a file to the report, events of files still in progress are ignored
+func (m *Migrate) reportEvent(file rocketchat.File, event ProgressEvent) {
+	status := ""
+
+	switch {
+	case event.Phase == PhaseCompleted:
+		status = "migrated"
+	case event.Phase == PhaseSkipped:
+		status = "skipped"
+	case event.Err != nil:
+		status = "failed"
+	default:
+		return
+	}
+
+	record := reportRecord{
+		ID:               file.ID,
+		Name:             file.Name,
+		SourceStore:      m.sourceStore.StoreType() + ":" + m.storeName,
+		DestinationStore: m.destinationStore.StoreType() + ":" + m.storeName,
+		Status:           status,
+	}
+
+	if objectPath, err := m.getObjectPath(&file); err == nil {
+		record.ObjectPath = objectPath
+	}
+
+	if event.Err != nil {
+		record.Error = event.Err.Error()
+	}
+
+	m.report.mu.Lock()
+	defer m.report.mu.Unlock()
+
+	m.report.Files = append(m.report.Files, record)
+}
+
+// writeReport finishes the report with the outcome of the run and writes it to the report file
+func (m *Migrate) writeReport(result *MigrationResult, runErr error) error {
+	m.report.FinishedAt = time.Now()
+
+	if runErr != nil {
+		m.report.Error = runErr.Error()
+	}
+
+	if result != nil {
+		m.report.Counts = reportCounts{
+			Total:             result.Total,
+			Migrated:          result.Migrated,
+			AlreadyMigrated:   result.AlreadyMigrated,
+			SkippedIncomplete: result.SkippedIncomplete,
+			SkippedMissing:    result.SkippedMissing,
+			Failed:            result.Failed,
+		}
+	}
+
+	content, err := json.MarshalIndent(m.report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(m.reportFile, content, 0644)
+}
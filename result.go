@@ -0,0 +1,131 @@
+package migrator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/RocketChat/filestore-migrator/store"
+)
+
+// MigrationResult summarizes what happened to the files of a migration run
+type MigrationResult struct {
+	Store             string
+	Total             int
+	Migrated          int
+	SkippedIncomplete int
+	SkippedMissing    int
+	Failed            int
+	FailedFiles       []string
+	MissingFiles      []string
+	IncompleteFiles   []string
+	BytesDownloaded   int64
+	BytesUploaded     int64
+	Elapsed           time.Duration
+	// AverageMBps is the uploaded megabytes (MiB) per second over Elapsed
+	AverageMBps float64
+	// AlreadyMigrated counts the matching files that were in the destination store before the run and weren't looked at
+	AlreadyMigrated int
+	// Stores holds the result of every store of a MigrateAllStores run
+	Stores []*MigrationResult
+
+	mu sync.Mutex
+}
+
+// merge adds the counts of other, a nil other is ignored
+func (r *MigrationResult) merge(other *MigrationResult) {
+	if other == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	other.mu.Lock()
+	defer other.mu.Unlock()
+
+	r.Total += other.Total
+	r.Migrated += other.Migrated
+	r.AlreadyMigrated += other.AlreadyMigrated
+	r.SkippedIncomplete += other.SkippedIncomplete
+	r.SkippedMissing += other.SkippedMissing
+	r.Failed += other.Failed
+	r.FailedFiles = append(r.FailedFiles, other.FailedFiles...)
+	r.MissingFiles = append(r.MissingFiles, other.MissingFiles...)
+	r.IncompleteFiles = append(r.IncompleteFiles, other.IncompleteFiles...)
+	r.BytesDownloaded += other.BytesDownloaded
+	r.BytesUploaded += other.BytesUploaded
+	r.Elapsed += other.Elapsed
+	r.AverageMBps = averageMBps(r.BytesUploaded, r.Elapsed)
+}
+
+// addBytes counts transferred bytes, it is safe to call on a nil result
+func (r *MigrationResult) addBytes(downloaded int64, uploaded int64) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.BytesDownloaded += downloaded
+	r.BytesUploaded += uploaded
+}
+
+// finish sets the elapsed time of a run that began at start and the resulting throughput
+func (r *MigrationResult) finish(start time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Elapsed = time.Since(start)
+	r.AverageMBps = averageMBps(r.BytesUploaded, r.Elapsed)
+}
+
+// summary describes the amount of data moved and how fast
+func (r *MigrationResult) summary() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return fmt.Sprintf("%d of %d files, %.2f MB downloaded and %.2f MB uploaded in %s (%.2f MB/s)",
+		r.Migrated, r.Total, float64(r.BytesDownloaded)/(1<<20), float64(r.BytesUploaded)/(1<<20), r.Elapsed.Round(time.Second), r.AverageMBps)
+}
+
+func averageMBps(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(bytes) / (1 << 20) / elapsed.Seconds()
+}
+
+// fileSize returns the size of the file at path, 0 when it can't be read
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+// record updates the counts from a file's progress event
+func (r *MigrationResult) record(event ProgressEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case event.Phase == PhaseCompleted:
+		r.Migrated++
+	case event.Phase == PhaseSkipped && event.Err == ErrFileIncomplete:
+		r.SkippedIncomplete++
+		r.IncompleteFiles = append(r.IncompleteFiles, event.FileID)
+	case event.Phase == PhaseSkipped && errors.Is(event.Err, store.ErrNotFound):
+		r.SkippedMissing++
+		r.MissingFiles = append(r.MissingFiles, event.FileID)
+	case event.Err != nil:
+		r.Failed++
+		r.FailedFiles = append(r.FailedFiles, event.FileID)
+	}
+}
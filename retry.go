@@ -0,0 +1,160 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/RocketChat/filestore-migrator/store"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// defaultDatabaseRetryTimeout is long enough for a replica set to elect a new primary
+const defaultDatabaseRetryTimeout = 2 * time.Minute
+
+// retryMaxDelay caps the delay between download and upload attempts, unless the base delay is longer already
+const retryMaxDelay = 30 * time.Second
+
+// databaseRetryBaseDelay is the first delay between database attempts, it doubles up to databaseRetryMaxDelay
+const (
+	databaseRetryBaseDelay = 500 * time.Millisecond
+	databaseRetryMaxDelay  = 15 * time.Second
+)
+
+// transientDatabaseCodes are the server error codes of a primary stepping down or a node going away,
+// ie. NotWritablePrimary, PrimarySteppedDown and InterruptedDueToReplStateChange
+var transientDatabaseCodes = []int{6, 7, 89, 91, 189, 262, 9001, 10107, 11600, 11602, 13435, 13436}
+
+// SetRetryPolicy retries downloads and uploads that fail with a transient error up to maxAttempts times.
+// The delay between attempts starts at baseDelay and doubles every attempt up to 30 seconds, with some jitter added
+func (m *Migrate) SetRetryPolicy(maxAttempts int, baseDelay time.Duration) error {
+	if maxAttempts < 1 {
+		return errors.New("max attempts must be at least 1")
+	}
+
+	if baseDelay < 0 {
+		return errors.New("base delay can't be negative")
+	}
+
+	m.retryAttempts = maxAttempts
+	m.retryBaseDelay = baseDelay
+
+	return nil
+}
+
+// withRetry runs operation until it succeeds, fails with a permanent error or runs out of attempts
+func (m *Migrate) withRetry(ctx context.Context, name string, operation func() error) error {
+	attempts := m.retryAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil || attempt >= attempts || !store.IsTransient(err) {
+			return err
+		}
+
+		delay := m.retryDelay(attempt)
+		delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+
+		m.debugf("%s failed on attempt %v/%v, retrying in %s: %v", name, attempt, attempts, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryDelay returns the delay, without jitter, after the given failed attempt. It doubles from the base delay up to
+// retryMaxDelay, a base delay above that is used as is
+func (m *Migrate) retryDelay(attempt int) time.Duration {
+	maxDelay := retryMaxDelay
+	if m.retryBaseDelay > maxDelay {
+		maxDelay = m.retryBaseDelay
+	}
+
+	delay := m.retryBaseDelay
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	return delay
+}
+
+// SetDatabaseRetryTimeout sets how long database operations failing with a transient error, ie. during a replica set
+// failover, are retried with an increasing delay before the error is returned. Defaults to 2 minutes
+func (m *Migrate) SetDatabaseRetryTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return errors.New("database retry timeout must be positive")
+	}
+
+	m.databaseRetryTimeout = timeout
+
+	return nil
+}
+
+func (m *Migrate) databaseRetryTimeoutOrDefault() time.Duration {
+	if m.databaseRetryTimeout > 0 {
+		return m.databaseRetryTimeout
+	}
+
+	return defaultDatabaseRetryTimeout
+}
+
+// withDatabaseRetry runs operation until it succeeds, fails with a permanent error or the database retry timeout is over.
+// The driver already retries a write once on its own, this covers failovers that take longer
+func (m *Migrate) withDatabaseRetry(ctx context.Context, name string, operation func() error) error {
+	deadline := time.Now().Add(m.databaseRetryTimeoutOrDefault())
+	delay := databaseRetryBaseDelay
+
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil || ctx.Err() != nil || !isTransientDatabaseError(err) || time.Now().Add(delay).After(deadline) {
+			return err
+		}
+
+		m.infof("%s failed on attempt %v, retrying in %s: %v", name, attempt, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > databaseRetryMaxDelay {
+			delay = databaseRetryMaxDelay
+		}
+	}
+}
+
+// isTransientDatabaseError tells whether err is worth retrying, as the server was unreachable or not the primary
+func isTransientDatabaseError(err error) bool {
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+
+	if serverErr.HasErrorLabel("RetryableWriteError") || serverErr.HasErrorLabel("TransientTransactionError") {
+		return true
+	}
+
+	for _, code := range transientDatabaseCodes {
+		if serverErr.HasErrorCode(code) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,30 @@
+package migrator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		baseDelay time.Duration
+		attempt   int
+		want      time.Duration
+	}{
+		{baseDelay: time.Second, attempt: 1, want: time.Second},
+		{baseDelay: time.Second, attempt: 3, want: 4 * time.Second},
+		{baseDelay: time.Second, attempt: 6, want: retryMaxDelay},
+		// Shifting the base delay this far would overflow into a negative delay
+		{baseDelay: time.Second, attempt: 100, want: retryMaxDelay},
+		{baseDelay: time.Minute, attempt: 5, want: time.Minute},
+		{baseDelay: 0, attempt: 10, want: 0},
+	}
+
+	for _, tt := range tests {
+		m := &Migrate{retryBaseDelay: tt.baseDelay}
+
+		if got := m.retryDelay(tt.attempt); got != tt.want {
+			t.Errorf("retryDelay(%d) with base delay %s = %s, want %s", tt.attempt, tt.baseDelay, got, tt.want)
+		}
+	}
+}
@@ -4,23 +4,27 @@ import "time"
 
 // File represents the structure of the file in Rocket.Chats database
 type File struct {
-	ID            string `bson:"_id"`
-	Name          string
-	Size          int
-	Type          string
-	Rid           string
-	UserID        string `bson:"userId"`
-	Description   string
-	Store         string
-	Complete      bool
-	Uploading     bool
-	Extension     string
-	Progress      int
-	AmazonS3      AmazonS3      `bson:"AmazonS3,omitempty"`
-	GoogleStorage GoogleStorage `bson:"GoogleStorage,omitempty"`
-	UpdatedAt     time.Time     `bson:"_updatedAt"`
-	InstanceID    string        `bson:"instanceId"`
-	Identify      struct {
+	ID               string `bson:"_id"`
+	Name             string
+	Size             int
+	Type             string
+	Rid              string
+	UserID           string `bson:"userId"`
+	Username         string `bson:"username,omitempty"`
+	Description      string
+	Store            string
+	Complete         bool
+	Uploading        bool
+	Extension        string
+	Progress         int
+	AmazonS3         AmazonS3         `bson:"AmazonS3,omitempty"`
+	GoogleStorage    GoogleStorage    `bson:"GoogleStorage,omitempty"`
+	AzureBlobStorage AzureBlobStorage `bson:"AzureBlobStorage,omitempty"`
+	WebDAV           WebDAV           `bson:"WebDAV,omitempty"`
+	SFTP             SFTP             `bson:"SFTP,omitempty"`
+	UpdatedAt        time.Time        `bson:"_updatedAt"`
+	InstanceID       string           `bson:"instanceId"`
+	Identify         struct {
 		Format string
 		Size   struct {
 			Width  int
@@ -32,6 +36,23 @@ type File struct {
 	UploadedAt time.Time `bson:"uploadedAt"`
 	Path       string
 	URL        string
+
+	// The location of the file before it was migrated, only kept when the migration was asked to preserve it
+	PreviousStore     string         `bson:"previousStore,omitempty"`
+	PreviousPath      string         `bson:"previousPath,omitempty"`
+	PreviousURL       string         `bson:"previousUrl,omitempty"`
+	PreviousReference StoreReference `bson:"previousReference,omitempty"`
+}
+
+// StoreReference names a store sub document of a file, ie. AmazonS3, along with its path
+type StoreReference struct {
+	Name string
+	Path string
+}
+
+// IsZero lets omitempty drop the sub property when it isn't set
+func (s StoreReference) IsZero() bool {
+	return s.Name == ""
 }
 
 // GoogleStorage is sub property of file
@@ -39,7 +60,47 @@ type GoogleStorage struct {
 	Path string
 }
 
+// IsZero lets omitempty drop the sub property when it isn't set
+func (g GoogleStorage) IsZero() bool {
+	return g.Path == ""
+}
+
 // AmazonS3 is a sub property of file
 type AmazonS3 struct {
 	Path string
 }
+
+// IsZero lets omitempty drop the sub property when it isn't set
+func (a AmazonS3) IsZero() bool {
+	return a.Path == ""
+}
+
+// AzureBlobStorage is a sub property of file
+type AzureBlobStorage struct {
+	Path string
+}
+
+// IsZero lets omitempty drop the sub property when it isn't set
+func (a AzureBlobStorage) IsZero() bool {
+	return a.Path == ""
+}
+
+// WebDAV is a sub property of file
+type WebDAV struct {
+	Path string
+}
+
+// IsZero lets omitempty drop the sub property when it isn't set
+func (w WebDAV) IsZero() bool {
+	return w.Path == ""
+}
+
+// SFTP is a sub property of file
+type SFTP struct {
+	Path string
+}
+
+// IsZero lets omitempty drop the sub property when it isn't set
+func (s SFTP) IsZero() bool {
+	return s.Path == ""
+}
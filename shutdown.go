@@ -0,0 +1,102 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// defaultShutdownGracePeriod is how long files in flight may take to finish once a run is stopped
+const defaultShutdownGracePeriod = 30 * time.Second
+
+// ErrShutdown is returned by a run that was stopped with Shutdown
+var ErrShutdown = errors.New("migration was shut down")
+
+// SetShutdownGracePeriod sets how long files in flight may take to finish after Shutdown or cancelling the context of a run
+// before their work is cancelled as well
+func (m *Migrate) SetShutdownGracePeriod(gracePeriod time.Duration) {
+	m.gracePeriod = gracePeriod
+}
+
+// Shutdown stops the running operation from starting further files. Files in flight get the grace period to finish,
+// after which the checkpoint is written, so the run can be resumed where it stopped.
+// Shutdown is sticky, runs started afterwards, ie. of the next store, stop right away with ErrShutdown. It may be
+// called before the first run as well, a new Migrate is needed to run again
+func (m *Migrate) Shutdown() {
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+
+	m.shutdown = true
+
+	if m.stopRun != nil {
+		m.stopRun()
+	}
+}
+
+func (m *Migrate) shutdownGracePeriod() time.Duration {
+	if m.gracePeriod > 0 {
+		return m.gracePeriod
+	}
+
+	return defaultShutdownGracePeriod
+}
+
+// startRun sets up the contexts of a run. scheduleCtx ends when ctx is cancelled, Shutdown is or was called or stop is
+// called, no further files should be started then. workCtx is for the files in flight and only ends after the grace period.
+// done must be called once the run is over
+func (m *Migrate) startRun(ctx context.Context) (scheduleCtx context.Context, workCtx context.Context, stop func(), done func()) {
+	scheduleCtx, stopSchedule := context.WithCancel(ctx)
+	workCtx, abort := context.WithCancel(context.Background())
+
+	m.runMu.Lock()
+	m.stopRun = stopSchedule
+	if m.shutdown {
+		stopSchedule()
+	}
+	m.runMu.Unlock()
+
+	finished := make(chan struct{})
+
+	go func() {
+		select {
+		case <-scheduleCtx.Done():
+		case <-finished:
+			return
+		}
+
+		select {
+		case <-time.After(m.shutdownGracePeriod()):
+			m.infof("Grace period of %s is over, cancelling the files in flight", m.shutdownGracePeriod())
+			abort()
+		case <-finished:
+		}
+	}()
+
+	done = func() {
+		close(finished)
+		abort()
+		stopSchedule()
+
+		m.runMu.Lock()
+		m.stopRun = nil
+		m.runMu.Unlock()
+	}
+
+	return scheduleCtx, workCtx, stopSchedule, done
+}
+
+// stoppedErr is the error of a run whose scheduling ended without a file failing
+func (m *Migrate) stoppedErr(ctx context.Context, scheduleCtx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+
+	if m.shutdown && scheduleCtx.Err() != nil {
+		return ErrShutdown
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package migrator
+
+import (
+	"context"
+	"testing"
+)
+
+func TestShutdownIsSticky(t *testing.T) {
+	m := &Migrate{}
+
+	// A shutdown before the first run stops it, as well as every following one
+	m.Shutdown()
+
+	for run := 1; run <= 2; run++ {
+		scheduleCtx, _, _, done := m.startRun(context.Background())
+
+		if scheduleCtx.Err() == nil {
+			t.Errorf("run %d: scheduling wasn't stopped", run)
+		}
+
+		if err := m.stoppedErr(context.Background(), scheduleCtx); err != ErrShutdown {
+			t.Errorf("run %d: stoppedErr() = %v, want ErrShutdown", run, err)
+		}
+
+		done()
+	}
+}
+
+func TestShutdownStopsRunningRun(t *testing.T) {
+	m := &Migrate{}
+
+	scheduleCtx, _, _, done := m.startRun(context.Background())
+	defer done()
+
+	if scheduleCtx.Err() != nil {
+		t.Fatal("scheduling stopped without a shutdown")
+	}
+
+	m.Shutdown()
+
+	if scheduleCtx.Err() == nil {
+		t.Error("Shutdown() didn't stop scheduling")
+	}
+
+	if err := m.stoppedErr(context.Background(), scheduleCtx); err != ErrShutdown {
+		t.Errorf("stoppedErr() = %v, want ErrShutdown", err)
+	}
+}
@@ -0,0 +1,337 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+)
+
+// AzureBlobProvider provides methods to use Azure Blob Storage as a storage provider.
+// Either AccountName and AccountKey or a ConnectionString must be provided.
+type AzureBlobProvider struct {
+	AccountName      string
+	AccountKey       string
+	ConnectionString string
+	Endpoint         string
+	Container        string
+	TempFileLocation string
+
+	limiter *RateLimiter
+}
+
+// StoreType returns the name of the store
+func (a *AzureBlobProvider) StoreType() string {
+	return "AzureBlobStorage"
+}
+
+// SetTempDirectory allows for the setting of the directory that will be used for temporary file store during operations
+func (a *AzureBlobProvider) SetTempDirectory(dir string) {
+	a.TempFileLocation = dir
+}
+
+// SetRateLimiter makes downloads and uploads count against limiter, nil removes the limit
+func (a *AzureBlobProvider) SetRateLimiter(limiter *RateLimiter) {
+	a.limiter = limiter
+}
+
+// Close does nothing, a pipeline is created for every operation
+func (a *AzureBlobProvider) Close() error {
+	return nil
+}
+
+func (a *AzureBlobProvider) containerURL() (azblob.ContainerURL, error) {
+	accountName := a.AccountName
+	accountKey := a.AccountKey
+	endpoint := a.Endpoint
+
+	if a.ConnectionString != "" {
+		settings := parseAzureConnectionString(a.ConnectionString)
+
+		accountName = settings["AccountName"]
+		accountKey = settings["AccountKey"]
+		endpoint = settings["BlobEndpoint"]
+
+		if endpoint == "" && accountName != "" {
+			protocol := settings["DefaultEndpointsProtocol"]
+			if protocol == "" {
+				protocol = "https"
+			}
+
+			suffix := settings["EndpointSuffix"]
+			if suffix == "" {
+				suffix = "core.windows.net"
+			}
+
+			endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, accountName, suffix)
+		}
+	}
+
+	if accountName == "" || accountKey == "" {
+		return azblob.ContainerURL{}, errors.New("missing azure account name or key")
+	}
+
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", accountName)
+	}
+
+	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return azblob.ContainerURL{}, err
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + a.Container)
+	if err != nil {
+		return azblob.ContainerURL{}, err
+	}
+
+	return azblob.NewContainerURL(*u, azblob.NewPipeline(credential, azblob.PipelineOptions{})), nil
+}
+
+// accountName returns the storage account, taken from the connection string when there is one
+func (a *AzureBlobProvider) accountName() string {
+	if a.ConnectionString != "" {
+		return parseAzureConnectionString(a.ConnectionString)["AccountName"]
+	}
+
+	return a.AccountName
+}
+
+// parseAzureConnectionString splits a connection string of the form Key1=Value1;Key2=Value2
+func parseAzureConnectionString(connectionString string) map[string]string {
+	settings := make(map[string]string)
+
+	for _, part := range strings.Split(connectionString, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		settings[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return settings
+}
+
+func isAzureNotFound(err error) bool {
+	if stgErr, ok := err.(azblob.StorageError); ok {
+		// Responses to HEAD requests carry no body, so there is only the status to go by
+		if resp := stgErr.Response(); resp != nil && resp.StatusCode == http.StatusNotFound {
+			return true
+		}
+
+		return stgErr.ServiceCode() == azblob.ServiceCodeBlobNotFound
+	}
+
+	return false
+}
+
+// Download downloads a file from the storage provider and moves it to the temporary file store
+func (a *AzureBlobProvider) Download(fileCollection string, file rocketchat.File) (string, error) {
+	containerURL, err := a.containerURL()
+	if err != nil {
+		return "", err
+	}
+
+	return downloadToTemp(a.TempFileLocation, file, func(f *os.File) error {
+		if file.AzureBlobStorage.Path == "" {
+			return ErrNotFound
+		}
+
+		if err := a.downloadBlob(containerURL.NewBlobURL(file.AzureBlobStorage.Path), f); err != nil {
+			if isAzureNotFound(err) {
+				return ErrNotFound
+			}
+
+			return err
+		}
+
+		return nil
+	})
+}
+
+// downloadBlob writes the blob to f, streaming it through the limiter when one is set
+func (a *AzureBlobProvider) downloadBlob(blobURL azblob.BlobURL, f *os.File) error {
+	ctx := context.Background()
+
+	if a.limiter == nil {
+		return azblob.DownloadBlobToFile(ctx, blobURL, 0, azblob.CountToEnd, f, azblob.DownloadFromBlobOptions{})
+	}
+
+	resp, err := blobURL.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return err
+	}
+
+	body := resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3})
+	defer body.Close()
+
+	_, err = io.Copy(f, a.limiter.Reader(body))
+
+	return err
+}
+
+// Upload uploads a file from given path to the storage provider
+func (a *AzureBlobProvider) Upload(objectPath string, filePath string, contentType string) error {
+	containerURL, err := a.containerURL()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		log.Println(err)
+		return errors.New("problem opening file to upload")
+	}
+
+	defer file.Close()
+
+	blobURL := containerURL.NewBlockBlobURL(objectPath)
+	headers := azblob.BlobHTTPHeaders{
+		ContentType: contentType,
+	}
+
+	if a.limiter != nil {
+		// The parallel file upload can't be throttled, stream the file through the limiter instead
+		_, err = azblob.UploadStreamToBlockBlob(context.Background(), a.limiter.Reader(file), blobURL, azblob.UploadStreamToBlockBlobOptions{
+			BlobHTTPHeaders: headers,
+		})
+	} else {
+		_, err = azblob.UploadFileToBlockBlob(context.Background(), file, blobURL, azblob.UploadToBlockBlobOptions{
+			BlobHTTPHeaders: headers,
+		})
+	}
+
+	if err != nil {
+		log.Println(err)
+		return fmt.Errorf("problem uploading file to container: %w", err)
+	}
+
+	return nil
+}
+
+// Stat reads the properties of the blob in the container
+func (a *AzureBlobProvider) Stat(objectPath string) (FileInfo, error) {
+	containerURL, err := a.containerURL()
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	props, err := containerURL.NewBlobURL(objectPath).GetProperties(context.Background(), azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if isAzureNotFound(err) {
+			return FileInfo{}, ErrNotFound
+		}
+
+		return FileInfo{}, err
+	}
+
+	return FileInfo{Size: props.ContentLength(), ContentType: props.ContentType(), Exists: true}, nil
+}
+
+// Delete removes the blob referenced by the file, a blob that is already gone is not an error
+func (a *AzureBlobProvider) Delete(fileCollection string, file rocketchat.File, permanentelyDelete bool) error {
+	if !permanentelyDelete {
+		return nil
+	}
+
+	containerURL, err := a.containerURL()
+	if err != nil {
+		return err
+	}
+
+	blobURL := containerURL.NewBlobURL(file.AzureBlobStorage.Path)
+
+	if _, err := blobURL.Delete(context.Background(), azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{}); err != nil && !isAzureNotFound(err) {
+		return fmt.Errorf("could not remove blob: %s: %s: %w", a.Container, file.AzureBlobStorage.Path, err)
+	}
+
+	return nil
+}
+
+// List returns the names of all blobs in the container starting with prefix
+func (a *AzureBlobProvider) List(prefix string) ([]string, error) {
+	containerURL, err := a.containerURL()
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		segment, err := containerURL.ListBlobsFlatSegment(context.Background(), marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, blob := range segment.Segment.BlobItems {
+			paths = append(paths, blob.Name)
+		}
+
+		marker = segment.NextMarker
+	}
+
+	return paths, nil
+}
+
+// DeleteObject removes the blob named objectPath from the container
+func (a *AzureBlobProvider) DeleteObject(objectPath string) error {
+	containerURL, err := a.containerURL()
+	if err != nil {
+		return err
+	}
+
+	if _, err := containerURL.NewBlobURL(objectPath).Delete(context.Background(), azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{}); err != nil && !isAzureNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Open streams the blob of the file from the container
+func (a *AzureBlobProvider) Open(fileCollection string, file rocketchat.File) (io.ReadCloser, int64, error) {
+	if file.AzureBlobStorage.Path == "" {
+		return nil, 0, ErrNotFound
+	}
+
+	containerURL, err := a.containerURL()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := containerURL.NewBlobURL(file.AzureBlobStorage.Path).Download(context.Background(), 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if isAzureNotFound(err) {
+			return nil, 0, ErrNotFound
+		}
+
+		return nil, 0, err
+	}
+
+	return a.limiter.ReadCloser(resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3})), resp.ContentLength(), nil
+}
+
+// UploadReader uploads the content of reader to a block blob, in blocks as it is read
+func (a *AzureBlobProvider) UploadReader(objectPath string, reader io.Reader, size int64, contentType string) error {
+	containerURL, err := a.containerURL()
+	if err != nil {
+		return err
+	}
+
+	_, err = azblob.UploadStreamToBlockBlob(context.Background(), a.limiter.Reader(reader), containerURL.NewBlockBlobURL(objectPath), azblob.UploadStreamToBlockBlobOptions{
+		BlobHTTPHeaders: azblob.BlobHTTPHeaders{ContentType: contentType},
+	})
+	if err != nil {
+		return fmt.Errorf("problem uploading file to container: %w", err)
+	}
+
+	return nil
+}
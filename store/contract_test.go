@@ -0,0 +1,166 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+)
+
+// providerContract describes how to run the contract every Provider has to fulfil against one implementation
+type providerContract struct {
+	// newProvider returns a provider working on an empty store, using tempDir as its temporary file store
+	newProvider func(t *testing.T, tempDir string) Provider
+	// locate points file at the object it is uploaded to and returns that object path
+	locate func(file *rocketchat.File) string
+}
+
+func TestFileSystemProviderContract(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		compress := compress
+
+		newProvider := func(t *testing.T, tempDir string) Provider {
+			return &FileSystemStorageProvider{Location: t.TempDir(), TempFileLocation: tempDir, Compress: compress}
+		}
+
+		// The file system store keeps files at <location>/<file id>
+		locate := func(file *rocketchat.File) string {
+			return file.ID
+		}
+
+		name := "plain"
+		if compress {
+			name = "compressed"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			testProviderContract(t, providerContract{newProvider: newProvider, locate: locate})
+		})
+	}
+}
+
+// testProviderContract checks the behaviour the migrator relies on from every provider
+func testProviderContract(t *testing.T, contract providerContract) {
+	t.Run("missing file", func(t *testing.T) {
+		provider := contract.newProvider(t, t.TempDir())
+
+		file := rocketchat.File{ID: "missing", Name: "missing.txt", Type: "text/plain"}
+		objectPath := contract.locate(&file)
+
+		path, err := provider.Download("rocketchat_uploads", file)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Download() error = %v, want ErrNotFound", err)
+		}
+
+		if err == nil && path == "" {
+			t.Error("Download() returned an empty path along with a nil error")
+		}
+
+		if _, err := provider.Stat(objectPath); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat() error = %v, want ErrNotFound", err)
+		}
+
+		if opener, ok := provider.(Opener); ok {
+			if _, _, err := opener.Open("rocketchat_uploads", file); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Open() error = %v, want ErrNotFound", err)
+			}
+		}
+
+		if err := provider.DeleteObject(objectPath); err != nil {
+			t.Errorf("DeleteObject() error = %v, a missing object is not an error", err)
+		}
+
+		if err := provider.Delete("rocketchat_uploads", file, true); err != nil {
+			t.Errorf("Delete() error = %v, a missing file is not an error", err)
+		}
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		tempDir := t.TempDir()
+		provider := contract.newProvider(t, tempDir)
+
+		content := []byte("the quick brown fox jumps over the lazy dog\n")
+		file := rocketchat.File{ID: "present", Name: "present.txt", Type: "text/plain", Size: len(content)}
+		objectPath := contract.locate(&file)
+
+		sourcePath := filepath.Join(t.TempDir(), "source")
+		if err := ioutil.WriteFile(sourcePath, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := provider.Upload(objectPath, sourcePath, file.Type); err != nil {
+			t.Fatalf("Upload() error = %v", err)
+		}
+
+		info, err := provider.Stat(objectPath)
+		if err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+
+		if !info.Exists || info.Size != int64(len(content)) {
+			t.Errorf("Stat() = %+v, want an existing object of %d bytes", info, len(content))
+		}
+
+		path, err := provider.Download("rocketchat_uploads", file)
+		if err != nil {
+			t.Fatalf("Download() error = %v", err)
+		}
+
+		downloaded, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(downloaded, content) {
+			t.Errorf("Download() content = %q, want %q", downloaded, content)
+		}
+
+		if opener, ok := provider.(Opener); ok {
+			reader, _, err := opener.Open("rocketchat_uploads", file)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+
+			opened, err := ioutil.ReadAll(reader)
+			reader.Close()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(opened, content) {
+				t.Errorf("Open() content = %q, want %q", opened, content)
+			}
+		}
+
+		paths, err := provider.List("")
+		if err != nil {
+			t.Fatalf("List() error = %v", err)
+		}
+
+		if !containsPath(paths, objectPath) {
+			t.Errorf("List() = %v, want it to contain %q", paths, objectPath)
+		}
+
+		if err := provider.DeleteObject(objectPath); err != nil {
+			t.Fatalf("DeleteObject() error = %v", err)
+		}
+
+		if _, err := provider.Stat(objectPath); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat() after DeleteObject() error = %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func containsPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+
+	return false
+}
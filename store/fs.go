@@ -1,17 +1,26 @@
 package store
 
 import (
-	"errors"
+	"compress/gzip"
+	"encoding/binary"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/RocketChat/filestore-migrator/rocketchat"
 )
 
 // FileSystemStorageProvider provides methods to use the local file system as a storage provider.
+// With Compress set, files of compressible content types are stored gzipped with a .gz suffix, their size recorded in the
+// gzip header, and decompressed again when read, this store can then only be read by the migrator. The migrator refuses to point
+// documents at a compressed destination, it can only be filled as a copy, ie. with updating the database disabled
 type FileSystemStorageProvider struct {
 	Location         string
 	TempFileLocation string
+	Compress         bool
+
+	limiter *RateLimiter
 }
 
 // StoreType returns the name of the store
@@ -24,61 +33,306 @@ func (f *FileSystemStorageProvider) SetTempDirectory(dir string) {
 	f.TempFileLocation = dir
 }
 
+// SetRateLimiter makes downloads and uploads count against limiter, nil removes the limit
+func (f *FileSystemStorageProvider) SetRateLimiter(limiter *RateLimiter) {
+	f.limiter = limiter
+}
+
+// Close does nothing, the file system holds no connections
+func (f *FileSystemStorageProvider) Close() error {
+	return nil
+}
+
 // Download downloads a file from the storage provider and moves it to the temporary file store
 func (f *FileSystemStorageProvider) Download(fileCollection string, file rocketchat.File) (string, error) {
-	sourcePath := f.Location + "/" + file.ID
-	destinationPath := f.TempFileLocation + "/" + file.ID
+	return downloadToTemp(f.TempFileLocation, file, func(dF *os.File) error {
+		sF, _, err := f.Open(fileCollection, file)
+		if err != nil {
+			return err
+		}
 
-	if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
-		return "", ErrNotFound
-	}
+		defer sF.Close()
 
-	sF, err := os.Open(sourcePath)
+		_, err = io.Copy(dF, sF)
+
+		return err
+	})
+}
+
+// Upload uploads a file from given path to the storage provider
+func (f *FileSystemStorageProvider) Upload(path string, filePath string, contentType string) error {
+	sF, err := os.Open(filePath)
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	defer sF.Close()
 
+	return f.UploadReader(path, sF, -1, contentType)
+}
+
+// UploadReader writes the content of reader to path below the store location
+func (f *FileSystemStorageProvider) UploadReader(path string, reader io.Reader, size int64, contentType string) error {
+	destinationPath := f.Location + "/" + path
+
+	// Object paths may contain directories
+	if err := os.MkdirAll(filepath.Dir(destinationPath), 0777); err != nil {
+		return err
+	}
+
+	compress := f.Compress && compressibleContentType(contentType)
+	if compress {
+		destinationPath += gzipSuffix
+	}
+
 	dF, err := os.Create(destinationPath)
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	defer dF.Close()
 
-	if _, err = io.Copy(dF, sF); err != nil {
-		return "", err
+	if !compress {
+		_, err = io.Copy(dF, f.limiter.Reader(reader))
+		return err
 	}
 
-	return destinationPath, nil
-}
+	gz := gzip.NewWriter(dF)
 
-// Upload uploads a file from given path to the storage provider
-func (f *FileSystemStorageProvider) Upload(path string, filePath string, contentType string) error {
-	destinationPath := f.Location + "/" + path
+	// The size is only known once written, a zero placeholder is filled in afterwards
+	gz.Header.Extra = make([]byte, gzipSizeFieldLength)
+	copy(gz.Header.Extra, gzipSizeFieldID)
+	binary.LittleEndian.PutUint16(gz.Header.Extra[2:], 8)
 
-	sF, err := os.Open(filePath)
+	written, err := io.Copy(gz, f.limiter.Reader(reader))
 	if err != nil {
 		return err
 	}
 
-	defer sF.Close()
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	sizeField := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sizeField, uint64(written))
+
+	_, err = dF.WriteAt(sizeField, gzipSizeOffset)
+
+	return err
+}
+
+// Open opens the file at <location>/<file id> for reading, gzipped files are decompressed while read
+func (f *FileSystemStorageProvider) Open(fileCollection string, file rocketchat.File) (io.ReadCloser, int64, error) {
+	sourcePath := f.Location + "/" + file.ID
+
+	sF, err := os.Open(sourcePath)
+	if os.IsNotExist(err) && f.Compress {
+		return f.openGzip(sourcePath + gzipSuffix)
+	}
 
-	dF, err := os.Create(destinationPath)
 	if err != nil {
-		return err
+		if os.IsNotExist(err) {
+			return nil, 0, ErrNotFound
+		}
+
+		return nil, 0, err
 	}
 
-	defer dF.Close()
+	info, err := sF.Stat()
+	if err != nil {
+		sF.Close()
+		return nil, 0, err
+	}
+
+	return f.limiter.ReadCloser(sF), info.Size(), nil
+}
 
-	if _, err = io.Copy(dF, sF); err != nil {
+func (f *FileSystemStorageProvider) openGzip(path string) (io.ReadCloser, int64, error) {
+	size, err := gzipSize(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, ErrNotFound
+		}
+
+		return nil, 0, err
+	}
+
+	sF, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	gz, err := gzip.NewReader(f.limiter.Reader(sF))
+	if err != nil {
+		sF.Close()
+		return nil, 0, err
+	}
+
+	return &gzipReadCloser{Reader: gz, file: sF}, size, nil
+}
+
+// Stat describes the file at path below the store location, gzipped files with their uncompressed size.
+// Files carry no content type on disk
+func (f *FileSystemStorageProvider) Stat(path string) (FileInfo, error) {
+	info, err := os.Stat(f.Location + "/" + path)
+	if os.IsNotExist(err) && f.Compress {
+		size, err := gzipSize(f.Location + "/" + path + gzipSuffix)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return FileInfo{}, ErrNotFound
+			}
+
+			return FileInfo{}, err
+		}
+
+		return FileInfo{Size: size, Exists: true}, nil
+	}
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return FileInfo{}, ErrNotFound
+		}
+
+		return FileInfo{}, err
+	}
+
+	return FileInfo{Size: info.Size(), Exists: true}, nil
+}
+
+// Delete removes the file from the store location, a file that is already gone is not an error
+func (f *FileSystemStorageProvider) Delete(fileCollection string, file rocketchat.File, permanentelyDelete bool) error {
+	if !permanentelyDelete {
+		return nil
+	}
+
+	return f.removeFile(f.Location + "/" + file.ID)
+}
+
+// removeFile removes the file at path along with its gzipped version
+func (f *FileSystemStorageProvider) removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
+	if f.Compress {
+		if err := os.Remove(path + gzipSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (s *FileSystemStorageProvider) Delete(file rocketchat.File, permanentelyDelete bool) error {
-	return errors.New("delete object method not implemented")
+// List returns the paths, relative to the store location, of all files starting with prefix
+func (f *FileSystemStorageProvider) List(prefix string) ([]string, error) {
+	var paths []string
+
+	err := filepath.Walk(f.Location, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		relative, err := filepath.Rel(f.Location, path)
+		if err != nil {
+			return err
+		}
+
+		relative = filepath.ToSlash(relative)
+		if f.Compress {
+			relative = strings.TrimSuffix(relative, gzipSuffix)
+		}
+
+		if strings.HasPrefix(relative, prefix) {
+			paths = append(paths, relative)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+}
+
+// DeleteObject removes the file at objectPath relative to the store location
+func (f *FileSystemStorageProvider) DeleteObject(objectPath string) error {
+	return f.removeFile(filepath.Join(f.Location, filepath.FromSlash(objectPath)))
+}
+
+const gzipSuffix = ".gz"
+
+// compressibleContentType tells whether gzip is worth it for the content type, media and archives are compressed already
+func compressibleContentType(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+xml"),
+		strings.HasSuffix(mediaType, "+json"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-javascript",
+		"application/x-yaml", "application/yaml", "application/rtf", "application/x-sh", "application/sql":
+		return true
+	}
+
+	return false
+}
+
+// The uncompressed size of a gzipped file is kept in a subfield of the gzip header, the trailer only holds it modulo 4 GiB.
+// The subfield takes the first 12 bytes of the extra field, which starts after the fixed 10 byte header and its length
+const (
+	gzipSizeFieldID     = "FM"
+	gzipSizeFieldLength = 12
+	gzipSizeOffset      = 10 + 2 + 4
+)
+
+// gzipSize returns the uncompressed size of the gzip file. Files written without the size in their header, ie. by older
+// versions, fall back to the size in the trailer, which is only exact below 4 GiB
+func gzipSize(path string) (int64, error) {
+	gzFile, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+
+	defer gzFile.Close()
+
+	gz, err := gzip.NewReader(gzFile)
+	if err != nil {
+		return 0, err
+	}
+
+	extra := gz.Header.Extra
+	if len(extra) >= gzipSizeFieldLength && string(extra[:2]) == gzipSizeFieldID && binary.LittleEndian.Uint16(extra[2:]) == 8 {
+		return int64(binary.LittleEndian.Uint64(extra[4:gzipSizeFieldLength])), nil
+	}
+
+	if _, err := gzFile.Seek(-4, io.SeekEnd); err != nil {
+		return 0, err
+	}
+
+	var size uint32
+	if err := binary.Read(gzFile, binary.LittleEndian, &size); err != nil {
+		return 0, err
+	}
+
+	return int64(size), nil
+}
+
+// gzipReadCloser closes the underlying file along with the gzip reader
+type gzipReadCloser struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
 }
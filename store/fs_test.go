@@ -0,0 +1,63 @@
+package store
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSystemGzipSize(t *testing.T) {
+	f := &FileSystemStorageProvider{Location: t.TempDir(), Compress: true}
+
+	content := strings.Repeat("compressible ", 1000)
+	if err := f.UploadReader("file-id", strings.NewReader(content), -1, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := f.Stat("file-id")
+	if err != nil || info.Size != int64(len(content)) {
+		t.Fatalf("Stat() = %+v, %v, want %d bytes", info, err, len(content))
+	}
+
+	// Files of 4 GiB or more don't fit the trailer, the size has to come from the header
+	gzFile, err := os.OpenFile(filepath.Join(f.Location, "file-id"+gzipSuffix), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := make([]byte, 8)
+	binary.LittleEndian.PutUint64(large, 5<<30)
+
+	_, err = gzFile.WriteAt(large, gzipSizeOffset)
+	gzFile.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := f.Stat("file-id"); err != nil || info.Size != 5<<30 {
+		t.Errorf("Stat() = %+v, %v, want the size from the header", info, err)
+	}
+}
+
+func TestFileSystemGzipSizeWithoutHeaderField(t *testing.T) {
+	f := &FileSystemStorageProvider{Location: t.TempDir(), Compress: true}
+
+	// Written by an older version, the trailer is all there is
+	gzFile, err := os.Create(filepath.Join(f.Location, "file-id"+gzipSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gz := gzip.NewWriter(gzFile)
+	gz.Write([]byte("content"))
+	gz.Close()
+	gzFile.Close()
+
+	if info, err := f.Stat("file-id"); err != nil || info.Size != int64(len("content")) {
+		t.Errorf("Stat() = %+v, %v, want %d bytes", info, err, len("content"))
+	}
+}
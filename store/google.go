@@ -3,21 +3,37 @@ package store
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 
 	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/storage/v1"
 )
 
 // GoogleStorageProvider provides methods to use the Google Cloud Storage offering as a storage provider.
+// The service account key is taken from JSONKey or the JSONKeyFile path,
+// without either the application default credentials of the environment are used.
+// Files of ChunkSize bytes or more, 8 MiB by default, are sent with a resumable upload in chunks of that size
 type GoogleStorageProvider struct {
 	JSONKey          string
+	JSONKeyFile      string
 	Bucket           string
+	ChunkSize        int
 	TempFileLocation string
+
+	// HTTPClient sends the requests to Google, including the token requests, ie. to go through a proxy or set TLS
+	// settings. Its Timeout applies to every request. Nil uses the default client, which follows HTTPS_PROXY
+	HTTPClient *http.Client
+
+	limiter *RateLimiter
 }
 
 // StoreType returns the name of the store
@@ -30,86 +46,250 @@ func (g *GoogleStorageProvider) SetTempDirectory(dir string) {
 	g.TempFileLocation = dir
 }
 
+// SetRateLimiter makes downloads and uploads count against limiter, nil removes the limit
+func (g *GoogleStorageProvider) SetRateLimiter(limiter *RateLimiter) {
+	g.limiter = limiter
+}
+
+// Close does nothing, a service is created for every operation
+func (g *GoogleStorageProvider) Close() error {
+	return nil
+}
+
+func (g *GoogleStorageProvider) service(ctx context.Context) (*storage.Service, error) {
+	jsonKey := []byte(g.JSONKey)
+
+	if len(jsonKey) == 0 && g.JSONKeyFile != "" {
+		var err error
+		if jsonKey, err = ioutil.ReadFile(g.JSONKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// The authenticated clients are built on the client found in the context
+	if g.HTTPClient != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, g.HTTPClient)
+	}
+
+	var client *http.Client
+
+	if len(jsonKey) == 0 {
+		var err error
+		if client, err = google.DefaultClient(ctx, storage.CloudPlatformScope); err != nil {
+			return nil, fmt.Errorf("no google storage json key given and no default credentials found: %w", err)
+		}
+	} else {
+		cfg, err := google.JWTConfigFromJSON(jsonKey, storage.CloudPlatformScope)
+		if err != nil {
+			return nil, err
+		}
+
+		client = cfg.Client(ctx)
+	}
+
+	// Only the transport is taken over from the context
+	if g.HTTPClient != nil {
+		client.Timeout = g.HTTPClient.Timeout
+	}
+
+	return storage.New(client)
+}
+
 // Download downloads a file from the storage provider and moves it to the temporary file store
 func (g *GoogleStorageProvider) Download(fileCollection string, file rocketchat.File) (string, error) {
 	ctx := context.Background()
 
-	cfg, err := google.JWTConfigFromJSON([]byte(g.JSONKey), "https://www.googleapis.com/auth/cloud-platform")
+	service, err := g.service(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	c := cfg.Client(ctx)
-
-	service, err := storage.New(c)
-
-	filePath := g.TempFileLocation + "/" + file.ID
-
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	return downloadToTemp(g.TempFileLocation, file, func(f *os.File) error {
+		if file.GoogleStorage.Path == "" {
+			return ErrNotFound
+		}
 
-		getCall := service.Objects.Get(g.Bucket, file.GoogleStorage.Path)
-		resp, err := getCall.Download()
+		resp, err := service.Objects.Get(g.Bucket, file.GoogleStorage.Path).Download()
 		if err != nil {
+			if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+				return ErrNotFound
+			}
+
 			if strings.Contains(err.Error(), "No such object:") {
-				return "", ErrNotFound
+				return ErrNotFound
 			}
 
-			return "", err
+			return err
 		}
 
 		defer resp.Body.Close()
 
-		f, err := os.Create(filePath)
-		if err != nil {
-			return "", err
-		}
+		_, err = io.Copy(f, g.limiter.Reader(resp.Body))
+
+		return err
+	})
+}
 
-		defer f.Close()
+// Open streams the object of the file from the bucket
+func (g *GoogleStorageProvider) Open(fileCollection string, file rocketchat.File) (io.ReadCloser, int64, error) {
+	if file.GoogleStorage.Path == "" {
+		return nil, 0, ErrNotFound
+	}
+
+	service, err := g.service(context.Background())
+	if err != nil {
+		return nil, 0, err
+	}
 
-		if _, err = io.Copy(f, resp.Body); err != nil {
-			return "", err
+	resp, err := service.Objects.Get(g.Bucket, file.GoogleStorage.Path).Download()
+	if err != nil {
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+			return nil, 0, ErrNotFound
 		}
+
+		return nil, 0, err
 	}
 
-	return filePath, nil
+	return g.limiter.ReadCloser(resp.Body), resp.ContentLength, nil
 }
 
 // Upload uploads a file from given path to the storage provider
 func (g *GoogleStorageProvider) Upload(path string, filePath string, contentType string) error {
-	ctx := context.Background()
+	file, err := os.Open(filePath)
+	if err != nil {
+		log.Println(err)
+		return errors.New("problem opening file to upload")
+	}
+
+	defer file.Close()
 
-	cfg, err := google.JWTConfigFromJSON([]byte(g.JSONKey), "https://www.googleapis.com/auth/cloud-platform")
+	return g.UploadReader(path, file, -1, contentType)
+}
+
+// UploadReader uploads the content of reader to the bucket, in chunks of ChunkSize when it is larger than that
+func (g *GoogleStorageProvider) UploadReader(path string, reader io.Reader, size int64, contentType string) error {
+	service, err := g.service(context.Background())
 	if err != nil {
 		return err
 	}
 
-	c := cfg.Client(ctx)
+	object := &storage.Object{
+		Name:        path,
+		ContentType: contentType,
+	}
 
-	service, err := storage.New(c)
+	chunkSize := g.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = googleapi.DefaultUploadChunkSize
+	}
 
-	file, err := os.Open(filePath)
+	// Files smaller than a chunk are still sent in a single request, only larger ones start a resumable session
+	mediaOptions := []googleapi.MediaOption{googleapi.ChunkSize(chunkSize)}
+	if contentType != "" {
+		mediaOptions = append(mediaOptions, googleapi.ContentType(contentType))
+	}
+
+	insertCall := service.Objects.Insert(g.Bucket, object).Media(g.limiter.Reader(reader), mediaOptions...)
+
+	_, err = insertCall.Do()
 	if err != nil {
 		log.Println(err)
-		return errors.New("problem opening file to upload")
+		return fmt.Errorf("problem uploading file to bucket: %w", err)
 	}
 
-	defer file.Close()
+	return nil
+}
 
-	object := &storage.Object{
-		Name: path,
+// Stat reads the attributes of the object in the bucket
+func (g *GoogleStorageProvider) Stat(path string) (FileInfo, error) {
+	ctx := context.Background()
+
+	service, err := g.service(ctx)
+	if err != nil {
+		return FileInfo{}, err
 	}
 
-	insertCall := service.Objects.Insert(g.Bucket, object).Media(file)
+	object, err := service.Objects.Get(g.Bucket, path).Do()
+	if err != nil {
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+			return FileInfo{}, ErrNotFound
+		}
 
-	_, err = insertCall.Do()
+		return FileInfo{}, err
+	}
+
+	return FileInfo{Size: int64(object.Size), ContentType: object.ContentType, Exists: true}, nil
+}
+
+// Delete removes the object referenced by the file, an object that is already gone is not an error
+func (g *GoogleStorageProvider) Delete(fileCollection string, file rocketchat.File, permanentelyDelete bool) error {
+	if !permanentelyDelete {
+		return nil
+	}
+
+	if file.GoogleStorage.Path == "" {
+		return errors.New("refusing to delete without an object path for file " + file.ID)
+	}
+
+	ctx := context.Background()
+
+	service, err := g.service(ctx)
 	if err != nil {
-		log.Println(err)
-		return errors.New("problem uploading file to bucket")
+		return err
+	}
+
+	if err := service.Objects.Delete(g.Bucket, file.GoogleStorage.Path).Do(); err != nil {
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+			return nil
+		}
+
+		return fmt.Errorf("could not remove object: %s: %s: %w", g.Bucket, file.GoogleStorage.Path, err)
 	}
 
 	return nil
 }
 
-func (s *GoogleStorageProvider) Delete(file rocketchat.File, permanentelyDelete bool) error {
-	return errors.New("delete object method not implemented")
+// List returns the names of all objects in the bucket starting with prefix
+func (g *GoogleStorageProvider) List(prefix string) ([]string, error) {
+	ctx := context.Background()
+
+	service, err := g.service(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+
+	err = service.Objects.List(g.Bucket).Prefix(prefix).Pages(ctx, func(objects *storage.Objects) error {
+		for _, object := range objects.Items {
+			paths = append(paths, object.Name)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+}
+
+// DeleteObject removes the object named objectPath from the bucket
+func (g *GoogleStorageProvider) DeleteObject(objectPath string) error {
+	ctx := context.Background()
+
+	service, err := g.service(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := service.Objects.Delete(g.Bucket, objectPath).Do(); err != nil {
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
 }
@@ -1,22 +1,38 @@
 package store
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"log"
 	"os"
+	"path"
+	"strings"
+	"sync"
 
 	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // GridFSProvider provides methods to use GridFS as a storage provider.
+// Files are kept in the bucket named after their file collection, ie. rocketchat_uploads, unless BucketNames maps the
+// collection to another bucket. Files are read with whatever chunk size they were written with, uploads use ChunkSizeBytes
+// or the driver's default of 255 KiB
 type GridFSProvider struct {
 	Database         string
 	Session          mongo.Session
 	TempFileLocation string
+	BucketNames      map[string]string
+	ChunkSizeBytes   int32
 
 	Buckets map[string]*gridfs.Bucket
+
+	bucketsMu sync.Mutex
+	limiter   *RateLimiter
 }
 
 // StoreType returns the name of the store
@@ -34,50 +50,265 @@ func (g *GridFSProvider) addBucket(bucketName string) (*gridfs.Bucket, error) {
 	return g.Buckets[bucketName], nil
 }
 
+// bucketName returns the bucket holding the files of the file collection
+func (g *GridFSProvider) bucketName(fileCollection string) string {
+	if bucketName, ok := g.BucketNames[fileCollection]; ok && bucketName != "" {
+		return bucketName
+	}
+
+	return fileCollection
+}
+
+func (g *GridFSProvider) getBucket(bucketName string) (*gridfs.Bucket, error) {
+	g.bucketsMu.Lock()
+	defer g.bucketsMu.Unlock()
+
+	if bucket, ok := g.Buckets[bucketName]; ok {
+		return bucket, nil
+	}
+
+	return g.addBucket(bucketName)
+}
+
+// SetSession switches the provider to a new database session, buckets of the previous one are dropped
+func (g *GridFSProvider) SetSession(session mongo.Session) {
+	g.bucketsMu.Lock()
+	defer g.bucketsMu.Unlock()
+
+	g.Session = session
+	g.Buckets = make(map[string]*gridfs.Bucket)
+}
+
+// Close drops the buckets, the session belongs to whoever set it and is left open
+func (g *GridFSProvider) Close() error {
+	g.bucketsMu.Lock()
+	defer g.bucketsMu.Unlock()
+
+	g.Buckets = make(map[string]*gridfs.Bucket)
+
+	return nil
+}
+
 // SetTempDirectory allows for the setting of the directory that will be used for temporary file store during operations
 func (g *GridFSProvider) SetTempDirectory(dir string) {
 	g.TempFileLocation = dir
 }
 
+// SetRateLimiter makes downloads and uploads count against limiter, nil removes the limit
+func (g *GridFSProvider) SetRateLimiter(limiter *RateLimiter) {
+	g.limiter = limiter
+}
+
 // Download downloads a file from the storage provider and moves it to the temporary file store
 func (g *GridFSProvider) Download(fileCollection string, file rocketchat.File) (string, error) {
+	bucket, err := g.getBucket(g.bucketName(fileCollection))
+	if err != nil {
+		return "", err
+	}
+
+	return downloadToTemp(g.TempFileLocation, file, func(f *os.File) error {
+		if _, err := bucket.DownloadToStream(file.ID, g.limiter.Writer(f)); err != nil {
+			if err == gridfs.ErrFileNotFound {
+				return ErrNotFound
+			}
 
-	var (
-		bucket *gridfs.Bucket
-		ok     bool
-		err    error
-	)
-	if bucket, ok = g.Buckets[fileCollection]; !ok {
-		bucket, err = g.addBucket(fileCollection)
-		if err != nil {
-			return "", err
+			return err
 		}
-	}
 
-	filePath := g.TempFileLocation + "/" + file.ID
+		return nil
+	})
+}
 
-	if _, err = os.Stat(filePath); os.IsNotExist(err) {
+// Open streams the file from the bucket of the file collection
+func (g *GridFSProvider) Open(fileCollection string, file rocketchat.File) (io.ReadCloser, int64, error) {
+	bucket, err := g.getBucket(g.bucketName(fileCollection))
+	if err != nil {
+		return nil, 0, err
+	}
 
-		f, err := os.Create(filePath)
-		if err != nil {
-			return "", err
+	stream, err := bucket.OpenDownloadStream(file.ID)
+	if err != nil {
+		if err == gridfs.ErrFileNotFound {
+			return nil, 0, ErrNotFound
 		}
 
-		if _, err = bucket.DownloadToStream(file.ID, f); err != nil {
-			return "", err
+		return nil, 0, err
+	}
+
+	return g.limiter.ReadCloser(stream), stream.GetFile().Length, nil
+}
+
+// Upload uploads a file from given path to the storage provider.
+// objectPath is expected as <file collection>/<file id>, an existing file with the same id is replaced
+func (g *GridFSProvider) Upload(objectPath string, filePath string, contentType string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		log.Println(err)
+		return errors.New("problem opening file to upload")
+	}
+
+	defer f.Close()
+
+	return g.UploadReader(objectPath, f, -1, contentType)
+}
+
+// UploadReader stores the content of reader under objectPath, given as <file collection>/<file id>.
+// An existing file with the same id is replaced
+func (g *GridFSProvider) UploadReader(objectPath string, reader io.Reader, size int64, contentType string) error {
+	fileCollection, fileID, err := splitGridFSPath(objectPath)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := g.getBucket(g.bucketName(fileCollection))
+	if err != nil {
+		return err
+	}
+
+	// Remove any previous copy so we don't end up with duplicate files for the same id
+	if err := bucket.Delete(fileID); err != nil && err != gridfs.ErrFileNotFound {
+		return err
+	}
+
+	uploadOpts := options.GridFSUpload().SetMetadata(bson.M{"contentType": contentType})
+	if g.ChunkSizeBytes > 0 {
+		uploadOpts.SetChunkSizeBytes(g.ChunkSizeBytes)
+	}
+
+	return bucket.UploadFromStreamWithID(fileID, fileID, g.limiter.Reader(reader), uploadOpts)
+}
+
+// Stat describes the file stored under objectPath, given as <file collection>/<file id>
+func (g *GridFSProvider) Stat(objectPath string) (FileInfo, error) {
+	fileCollection, fileID, err := splitGridFSPath(objectPath)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	bucket, err := g.getBucket(g.bucketName(fileCollection))
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	cursor, err := bucket.Find(bson.M{"_id": fileID})
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	defer cursor.Close(context.Background())
+
+	if !cursor.Next(context.Background()) {
+		if err := cursor.Err(); err != nil {
+			return FileInfo{}, err
 		}
 
-		f.Close()
+		return FileInfo{}, ErrNotFound
+	}
+
+	var stored struct {
+		Length   int64 `bson:"length"`
+		Metadata struct {
+			ContentType string `bson:"contentType"`
+		} `bson:"metadata"`
+	}
+
+	if err := cursor.Decode(&stored); err != nil {
+		return FileInfo{}, err
+	}
+
+	return FileInfo{Size: stored.Length, ContentType: stored.Metadata.ContentType, Exists: true}, nil
+}
+
+func splitGridFSPath(objectPath string) (string, string, error) {
+	bucketName, fileID := path.Split(objectPath)
+	bucketName = strings.TrimSuffix(bucketName, "/")
+
+	if bucketName == "" || fileID == "" {
+		return "", "", errors.New("invalid GridFS object path: " + objectPath)
+	}
+
+	return bucketName, fileID, nil
+}
+
+// Delete removes the file and its chunks from the bucket of fileCollection, the collection its document was read from.
+// Without permanentelyDelete nothing is removed, a file that is already gone is not an error
+func (g *GridFSProvider) Delete(fileCollection string, file rocketchat.File, permanentelyDelete bool) error {
+	if !permanentelyDelete {
+		log.Printf("skipping delete of %s from GridFS, permanent delete not requested\n", file.ID)
+		return nil
+	}
+
+	if fileCollection == "" {
+		return errors.New("unable to determine GridFS bucket without a file collection for " + file.ID)
+	}
+
+	bucket, err := g.getBucket(g.bucketName(fileCollection))
+	if err != nil {
+		return err
+	}
+
+	if err := bucket.Delete(file.ID); err != nil && err != gridfs.ErrFileNotFound {
+		return err
 	}
 
-	return filePath, nil
+	return nil
 }
 
-// Upload uploads a file from given path to the storage provider (not implemented)
-func (g *GridFSProvider) Upload(path string, filePath string, contentType string) error {
-	return errors.New("unimplemented")
+// List returns the paths, as <file collection>/<file id>, of all files starting with prefix.
+// The prefix has to name the file collection, ie. rocketchat_uploads/
+func (g *GridFSProvider) List(prefix string) ([]string, error) {
+	fileCollection := strings.SplitN(prefix, "/", 2)[0]
+	if fileCollection == "" || !strings.Contains(prefix, "/") {
+		return nil, errors.New("GridFS listing needs a prefix starting with the file collection: " + prefix)
+	}
+
+	bucket, err := g.getBucket(g.bucketName(fileCollection))
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := bucket.Find(bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	defer cursor.Close(context.Background())
+
+	var paths []string
+
+	for cursor.Next(context.Background()) {
+		var stored struct {
+			ID interface{} `bson:"_id"`
+		}
+
+		if err := cursor.Decode(&stored); err != nil {
+			return nil, err
+		}
+
+		objectPath := fileCollection + "/" + fmt.Sprint(stored.ID)
+		if strings.HasPrefix(objectPath, prefix) {
+			paths = append(paths, objectPath)
+		}
+	}
+
+	return paths, cursor.Err()
 }
 
-func (s *GridFSProvider) Delete(file rocketchat.File, permanentelyDelete bool) error {
-	return errors.New("unimplemented")
+// DeleteObject removes the file and its chunks stored under objectPath, given as <file collection>/<file id>
+func (g *GridFSProvider) DeleteObject(objectPath string) error {
+	fileCollection, fileID, err := splitGridFSPath(objectPath)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := g.getBucket(g.bucketName(fileCollection))
+	if err != nil {
+		return err
+	}
+
+	if err := bucket.Delete(fileID); err != nil && err != gridfs.ErrFileNotFound {
+		return err
+	}
+
+	return nil
 }
@@ -0,0 +1,38 @@
+package store
+
+import "testing"
+
+func TestGridFSBucketName(t *testing.T) {
+	g := &GridFSProvider{BucketNames: map[string]string{
+		"rocketchat_uploads": "uploads_bucket",
+		"rocketchat_avatars": "",
+	}}
+
+	tests := []struct {
+		fileCollection string
+		want           string
+	}{
+		{fileCollection: "rocketchat_uploads", want: "uploads_bucket"},
+		{fileCollection: "rocketchat_avatars", want: "rocketchat_avatars"},
+		{fileCollection: "rocketchat_userDataFiles", want: "rocketchat_userDataFiles"},
+	}
+
+	for _, tt := range tests {
+		if got := g.bucketName(tt.fileCollection); got != tt.want {
+			t.Errorf("bucketName(%q) = %q, want %q", tt.fileCollection, got, tt.want)
+		}
+	}
+}
+
+func TestSplitGridFSPath(t *testing.T) {
+	fileCollection, fileID, err := splitGridFSPath("rocketchat_uploads/file-id")
+	if err != nil || fileCollection != "rocketchat_uploads" || fileID != "file-id" {
+		t.Errorf("splitGridFSPath() = %q, %q, %v, want rocketchat_uploads, file-id", fileCollection, fileID, err)
+	}
+
+	for _, objectPath := range []string{"", "file-id", "rocketchat_uploads/", "/file-id"} {
+		if _, _, err := splitGridFSPath(objectPath); err == nil {
+			t.Errorf("splitGridFSPath(%q) didn't fail", objectPath)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// openPresignedURL downloads from presignedURL with client, the body is read through limiter
+func openPresignedURL(client *http.Client, limiter *RateLimiter, presignedURL string) (io.ReadCloser, int64, error) {
+	resp, err := client.Get(presignedURL)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, 0, ErrNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("unable to download from presigned url: %s", resp.Status)
+	}
+
+	return limiter.ReadCloser(resp.Body), resp.ContentLength, nil
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+)
+
+// countingTransport counts the requests it sends
+type countingTransport struct {
+	requests int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.requests, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestS3OpenPresignedUsesTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	transport := &countingTransport{}
+
+	// With a region set presigning needs no request, every request counted is a download
+	s := &S3Provider{Endpoint: server.URL, Bucket: "bucket", AccessID: "id", AccessKey: "key", Region: "us-east-1", Transport: transport}
+	s.SetRateLimiter(NewRateLimiter(1 << 20))
+
+	file := rocketchat.File{ID: "file-id"}
+	file.AmazonS3.Path = "uploads/file-id"
+
+	reader, size, err := s.OpenPresigned(file)
+	if err != nil {
+		t.Fatalf("OpenPresigned() error = %v", err)
+	}
+
+	content, err := ioutil.ReadAll(reader)
+	reader.Close()
+
+	if err != nil || string(content) != "content" || size != int64(len(content)) {
+		t.Errorf("OpenPresigned() = %q, %d, %v, want content", content, size, err)
+	}
+
+	file.AmazonS3.Path = "uploads/missing"
+
+	if _, _, err := s.OpenPresigned(file); !errors.Is(err, ErrNotFound) {
+		t.Errorf("OpenPresigned() of a missing object error = %v, want ErrNotFound", err)
+	}
+
+	if requests := atomic.LoadInt32(&transport.requests); requests != 2 {
+		t.Errorf("%d requests went through the transport, want 2", requests)
+	}
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimitChunk bounds a single read or write so a slow limit doesn't turn into long stalls
+const rateLimitChunk = 32 * 1024
+
+// RateLimiter caps the combined throughput of every reader and writer wrapped with it.
+// A nil RateLimiter doesn't limit anything
+type RateLimiter struct {
+	bytesPerSecond int64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// NewRateLimiter creates a limiter allowing bytesPerSecond across all of its readers and writers
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// wait blocks until n more bytes fit in the limit
+func (l *RateLimiter) wait(n int) {
+	if n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.bytesPerSecond))
+	delay := l.next.Sub(now)
+
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// Reader wraps r so reading from it counts against the limit
+func (l *RateLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil || l.bytesPerSecond <= 0 {
+		return r
+	}
+
+	return &limitedReader{r: r, limiter: l}
+}
+
+// Writer wraps w so writing to it counts against the limit
+func (l *RateLimiter) Writer(w io.Writer) io.Writer {
+	if l == nil || l.bytesPerSecond <= 0 {
+		return w
+	}
+
+	return &limitedWriter{w: w, limiter: l}
+}
+
+// ReadCloser wraps rc so reading from it counts against the limit, closing closes rc
+func (l *RateLimiter) ReadCloser(rc io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{l.Reader(rc), rc}
+}
+
+type limitedReader struct {
+	r       io.Reader
+	limiter *RateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitChunk {
+		p = p[:rateLimitChunk]
+	}
+
+	n, err := lr.r.Read(p)
+	lr.limiter.wait(n)
+
+	return n, err
+}
+
+type limitedWriter struct {
+	w       io.Writer
+	limiter *RateLimiter
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > rateLimitChunk {
+			chunk = chunk[:rateLimitChunk]
+		}
+
+		lw.limiter.wait(len(chunk))
+
+		n, err := lw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
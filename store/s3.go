@@ -2,15 +2,21 @@ package store
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/RocketChat/filestore-migrator/rocketchat"
 	minio "github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/minio/minio-go/v7/pkg/tags"
 )
 
 // S3Provider provides methods to use any S3 complaint provider as a storage provider.
@@ -21,7 +27,33 @@ type S3Provider struct {
 	AccessKey        string
 	Region           string
 	UseSSL           bool
+	ForcePathStyle   bool
 	TempFileLocation string
+
+	// ServerSideEncryption encrypts uploaded objects with S3 managed keys (AES256) or a KMS key (aws:kms).
+	// KMSKeyID picks the key, the account's default KMS key is used when it is empty
+	ServerSideEncryption string
+	KMSKeyID             string
+
+	// StorageClass of uploaded objects, ie. STANDARD_IA. Empty leaves it to S3, which uses STANDARD
+	StorageClass string
+
+	// Files larger than PartSize bytes are sent as a multipart upload of UploadConcurrency parts at a time.
+	// Zero values use the client defaults of 16MiB parts and 4 parts at a time
+	PartSize          uint64
+	UploadConcurrency uint
+
+	// TagObjects tags migrated objects with the rid, userId and store of their file, ie. for lifecycle rules
+	TagObjects bool
+
+	// PresignExpiry is how long presigned download URLs are valid, defaulting to 15 minutes
+	PresignExpiry time.Duration
+
+	// Transport sends the requests to S3, ie. to go through a proxy or set TLS and response timeouts.
+	// Nil uses the default transport, which follows HTTPS_PROXY
+	Transport http.RoundTripper
+
+	limiter *RateLimiter
 }
 
 // StoreType returns the name of the store
@@ -34,64 +66,209 @@ func (s *S3Provider) SetTempDirectory(dir string) {
 	s.TempFileLocation = dir
 }
 
+// SetRateLimiter makes downloads and uploads count against limiter, nil removes the limit
+func (s *S3Provider) SetRateLimiter(limiter *RateLimiter) {
+	s.limiter = limiter
+}
+
+// Close does nothing, a client is created for every operation
+func (s *S3Provider) Close() error {
+	return nil
+}
+
+func (s *S3Provider) client() (*minio.Client, error) {
+	endpoint := s.Endpoint
+	secure := s.UseSSL
+
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+
+	// Allow endpoints like https://minio.internal:9000, the scheme decides on ssl
+	if strings.HasPrefix(endpoint, "https://") {
+		secure = true
+	} else if strings.HasPrefix(endpoint, "http://") {
+		secure = false
+	}
+
+	endpoint = strings.TrimPrefix(strings.TrimPrefix(endpoint, "https://"), "http://")
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	bucketLookup := minio.BucketLookupAuto
+	if s.ForcePathStyle {
+		bucketLookup = minio.BucketLookupPath
+	}
+
+	return minio.New(endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(s.AccessID, s.AccessKey, ""),
+		Secure:       secure,
+		Region:       s.Region,
+		BucketLookup: bucketLookup,
+		Transport:    s.Transport,
+	})
+}
+
+func (s *S3Provider) serverSideEncryption() (encrypt.ServerSide, error) {
+	switch s.ServerSideEncryption {
+	case "":
+		return nil, nil
+	case "AES256":
+		return encrypt.NewSSE(), nil
+	case "aws:kms":
+		return encrypt.NewSSEKMS(s.KMSKeyID, nil)
+	default:
+		return nil, fmt.Errorf("unsupported server side encryption %q", s.ServerSideEncryption)
+	}
+}
+
 // Download will download the file to temp file store
 func (s *S3Provider) Download(fileCollection string, file rocketchat.File) (string, error) {
-	minioClient, err := minio.New(s.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(s.AccessID, s.AccessKey, ""),
-		Secure: s.UseSSL,
-		Region: s.Region,
-	})
+	minioClient, err := s.client()
 	if err != nil {
 		return "", err
 	}
 
-	filePath := s.TempFileLocation + "/" + file.ID
+	return downloadToTemp(s.TempFileLocation, file, func(f *os.File) error {
+		if file.AmazonS3.Path == "" {
+			return ErrNotFound
+		}
 
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		object, err := minioClient.GetObject(
-			context.Background(),
-			s.Bucket,
-			file.AmazonS3.Path,
-			minio.GetObjectOptions{},
-		)
+		object, err := minioClient.GetObject(context.Background(), s.Bucket, file.AmazonS3.Path, minio.GetObjectOptions{})
 		if err != nil {
-			return "", err
+			return err
 		}
 
-		f, err := os.Create(filePath)
-		if err != nil {
-			return "", err
+		defer object.Close()
+
+		if _, err = io.Copy(f, s.limiter.Reader(object)); err != nil {
+			// The object is only requested on the first read, so a missing one surfaces here
+			if s3Err := minio.ToErrorResponse(err); s3Err.StatusCode == http.StatusNotFound || s3Err.Code == "NoSuchKey" {
+				return ErrNotFound
+			}
+
+			return err
 		}
 
-		defer f.Close()
+		return nil
+	})
+}
 
-		if _, err = io.Copy(f, object); err != nil {
-			return "", err
+// PresignDownload returns a presigned GET URL for the object of the file
+func (s *S3Provider) PresignDownload(file rocketchat.File) (string, error) {
+	if file.AmazonS3.Path == "" {
+		return "", ErrNotFound
+	}
+
+	minioClient, err := s.client()
+	if err != nil {
+		return "", err
+	}
+
+	expiry := s.PresignExpiry
+	if expiry <= 0 {
+		expiry = 15 * time.Minute
+	}
+
+	presigned, err := minioClient.PresignedGetObject(context.Background(), s.Bucket, file.AmazonS3.Path, expiry, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return presigned.String(), nil
+}
+
+// OpenPresigned streams the object of the file from a presigned URL, requested over the provider's Transport
+func (s *S3Provider) OpenPresigned(file rocketchat.File) (io.ReadCloser, int64, error) {
+	presignedURL, err := s.PresignDownload(file)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return openPresignedURL(&http.Client{Transport: s.Transport}, s.limiter, presignedURL)
+}
+
+// Open streams the object of the file from the bucket
+func (s *S3Provider) Open(fileCollection string, file rocketchat.File) (io.ReadCloser, int64, error) {
+	if file.AmazonS3.Path == "" {
+		return nil, 0, ErrNotFound
+	}
+
+	minioClient, err := s.client()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	object, err := minioClient.GetObject(context.Background(), s.Bucket, file.AmazonS3.Path, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+
+		if s3Err := minio.ToErrorResponse(err); s3Err.StatusCode == http.StatusNotFound || s3Err.Code == "NoSuchKey" {
+			return nil, 0, ErrNotFound
 		}
 
+		return nil, 0, err
 	}
 
-	return filePath, nil
+	return s.limiter.ReadCloser(object), info.Size, nil
 }
 
 // Upload will upload the file from given file path
 func (s *S3Provider) Upload(objectPath string, filePath string, contentType string) error {
-	minioClient, err := minio.New(s.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(s.AccessID, s.AccessKey, ""),
-		Secure: s.UseSSL,
-		Region: s.Region,
-	})
+	minioClient, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		log.Println(err)
+		return errors.New("problem opening file to upload")
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return s.putObject(minioClient, objectPath, file, info.Size(), contentType)
+}
+
+// UploadReader uploads size bytes read from reader, an unknown size of -1 is uploaded in parts of PartSize
+func (s *S3Provider) UploadReader(objectPath string, reader io.Reader, size int64, contentType string) error {
+	minioClient, err := s.client()
 	if err != nil {
 		return err
 	}
 
-	_, err = minioClient.FPutObject(
+	return s.putObject(minioClient, objectPath, reader, size, contentType)
+}
+
+func (s *S3Provider) putObject(minioClient *minio.Client, objectPath string, reader io.Reader, size int64, contentType string) error {
+	sse, err := s.serverSideEncryption()
+	if err != nil {
+		return err
+	}
+
+	// Large files go up in parts, which only run in parallel when the file isn't streamed through the limiter
+	_, err = minioClient.PutObject(
 		context.Background(),
 		s.Bucket,
 		objectPath,
-		filePath,
+		s.limiter.Reader(reader),
+		size,
 		minio.PutObjectOptions{
-			ContentType: contentType,
+			ContentType:          contentType,
+			ServerSideEncryption: sse,
+			StorageClass:         s.StorageClass,
+			PartSize:             s.PartSize,
+			NumThreads:           s.UploadConcurrency,
 		},
 	)
 	if err != nil {
@@ -102,14 +279,29 @@ func (s *S3Provider) Upload(objectPath string, filePath string, contentType stri
 	return nil
 }
 
+// Stat reads the object's metadata from the bucket with a HEAD request
+func (s *S3Provider) Stat(objectPath string) (FileInfo, error) {
+	minioClient, err := s.client()
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	info, err := minioClient.StatObject(context.Background(), s.Bucket, objectPath, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+			return FileInfo{}, ErrNotFound
+		}
+
+		return FileInfo{}, err
+	}
+
+	return FileInfo{Size: info.Size, ContentType: info.ContentType, Exists: true}, nil
+}
+
 // Delete permanentely permanentely destroys an object specified by the
 // rocketFile.Amazons3.filepath
-func (s *S3Provider) Delete(file rocketchat.File, permanentelyDelete bool) error {
-	minioClient, err := minio.New(s.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(s.AccessID, s.AccessKey, ""),
-		Secure: s.UseSSL,
-		Region: s.Region,
-	})
+func (s *S3Provider) Delete(fileCollection string, file rocketchat.File, permanentelyDelete bool) error {
+	minioClient, err := s.client()
 	if err != nil {
 		return err
 	}
@@ -119,6 +311,11 @@ func (s *S3Provider) Delete(file rocketchat.File, permanentelyDelete bool) error
 	// removes the bucket name from the Path if it exists
 	objectPrefix := strings.TrimPrefix(file.AmazonS3.Path, s.Bucket)
 
+	// An empty prefix would match every object in the bucket
+	if objectPrefix == "" {
+		return errors.New("refusing to delete without an object path for file " + file.ID)
+	}
+
 	// chan of objects withing the deployment object
 	objectsCh := make(chan string)
 
@@ -168,3 +365,87 @@ func (s *S3Provider) Delete(file rocketchat.File, permanentelyDelete bool) error
 
 	return nil
 }
+
+// List returns the keys of all objects in the bucket starting with prefix
+func (s *S3Provider) List(prefix string) ([]string, error) {
+	minioClient, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+
+	for object := range minioClient.ListObjects(context.Background(), s.Bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+
+		paths = append(paths, object.Key)
+	}
+
+	return paths, nil
+}
+
+// DeleteObject removes the object with the key objectPath
+func (s *S3Provider) DeleteObject(objectPath string) error {
+	minioClient, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	return minioClient.RemoveObject(context.Background(), s.Bucket, objectPath, minio.RemoveObjectOptions{})
+}
+
+// s3MaxTagValueLength is the length limit of tag values in characters, keys may have 128 and objects 10 tags
+const s3MaxTagValueLength = 256
+
+// TagObject sets the rid, userId and store tags on the object when TagObjects is enabled, replacing any tags it had.
+// Empty values are left out
+func (s *S3Provider) TagObject(objectPath string, file rocketchat.File, storeName string) error {
+	if !s.TagObjects {
+		return nil
+	}
+
+	tagMap := make(map[string]string)
+
+	for key, value := range map[string]string{"rid": file.Rid, "userId": file.UserID, "store": storeName} {
+		if value = sanitizeS3TagValue(value); value != "" {
+			tagMap[key] = value
+		}
+	}
+
+	if len(tagMap) == 0 {
+		return nil
+	}
+
+	objectTags, err := tags.NewTags(tagMap, true)
+	if err != nil {
+		return err
+	}
+
+	minioClient, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	return minioClient.PutObjectTagging(context.Background(), s.Bucket, objectPath, objectTags, minio.PutObjectTaggingOptions{})
+}
+
+// sanitizeS3TagValue replaces the characters S3 doesn't allow in tags with underscores and cuts the value to the maximum length
+func sanitizeS3TagValue(value string) string {
+	var b strings.Builder
+
+	for i, r := range []rune(value) {
+		if i == s3MaxTagValueLength {
+			break
+		}
+
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) || strings.ContainsRune("+-=._:/@", r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+
+	return strings.TrimSpace(b.String())
+}
@@ -0,0 +1,381 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPProvider provides methods to use an SFTP server as a storage provider.
+// Objects are stored below Location on the server. The server is authenticated with KnownHostsFile,
+// checking it can only be skipped explicitly with InsecureIgnoreHostKey
+type SFTPProvider struct {
+	Host                  string
+	Port                  int
+	Username              string
+	Password              string
+	PrivateKey            string
+	PrivateKeyFile        string
+	PrivateKeyPassphrase  string
+	KnownHostsFile        string
+	InsecureIgnoreHostKey bool
+	Location              string
+	TempFileLocation      string
+
+	clientMu  sync.Mutex
+	sshClient *ssh.Client
+	client    *sftp.Client
+	limiter   *RateLimiter
+}
+
+// StoreType returns the name of the store
+func (s *SFTPProvider) StoreType() string {
+	return "SFTP"
+}
+
+// SetTempDirectory allows for the setting of the directory that will be used for temporary file store during operations
+func (s *SFTPProvider) SetTempDirectory(dir string) {
+	s.TempFileLocation = dir
+}
+
+// SetRateLimiter makes downloads and uploads count against limiter, nil removes the limit
+func (s *SFTPProvider) SetRateLimiter(limiter *RateLimiter) {
+	s.limiter = limiter
+}
+
+// sftpClient returns the connection shared by all operations, connecting when there is none yet
+func (s *SFTPProvider) sftpClient() (*sftp.Client, error) {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	config, err := s.sshConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	sshClient, err := ssh.Dial("tcp", net.JoinHostPort(s.Host, strconv.Itoa(s.port())), config)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+
+	s.sshClient = sshClient
+	s.client = client
+
+	return client, nil
+}
+
+// port returns the configured port, defaulting to 22
+func (s *SFTPProvider) port() int {
+	if s.Port == 0 {
+		return 22
+	}
+
+	return s.Port
+}
+
+func (s *SFTPProvider) sshConfig() (*ssh.ClientConfig, error) {
+	var auth []ssh.AuthMethod
+
+	privateKey := []byte(s.PrivateKey)
+	if s.PrivateKeyFile != "" {
+		var err error
+		if privateKey, err = ioutil.ReadFile(s.PrivateKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(privateKey) > 0 {
+		var (
+			signer ssh.Signer
+			err    error
+		)
+
+		if s.PrivateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(privateKey, []byte(s.PrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(privateKey)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse sftp private key: %w", err)
+		}
+
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	if s.Password != "" {
+		auth = append(auth, ssh.Password(s.Password))
+	}
+
+	if len(auth) == 0 {
+		return nil, errors.New("sftp needs a password or a private key")
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+
+	switch {
+	case s.KnownHostsFile != "":
+		var err error
+		if hostKeyCallback, err = knownhosts.New(s.KnownHostsFile); err != nil {
+			return nil, err
+		}
+	case s.InsecureIgnoreHostKey:
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	default:
+		return nil, errors.New("sftp needs a known hosts file to check the server's host key")
+	}
+
+	return &ssh.ClientConfig{
+		User:            s.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+// reset drops the connection after a failure, so the next operation connects again instead of reusing a broken one
+func (s *SFTPProvider) reset(client *sftp.Client) {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+
+	if s.client != client {
+		return
+	}
+
+	s.client.Close()
+	s.sshClient.Close()
+
+	s.client = nil
+	s.sshClient = nil
+}
+
+// Close ends the connection to the server
+func (s *SFTPProvider) Close() error {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+
+	if s.client == nil {
+		return nil
+	}
+
+	s.client.Close()
+	err := s.sshClient.Close()
+
+	s.client = nil
+	s.sshClient = nil
+
+	return err
+}
+
+func (s *SFTPProvider) remotePath(objectPath string) string {
+	return path.Join(s.Location, strings.TrimPrefix(objectPath, "/"))
+}
+
+// sftpFilePath returns where the file lives below Location, files that never had a path are stored by ID
+func sftpFilePath(file rocketchat.File) string {
+	if file.SFTP.Path != "" {
+		return file.SFTP.Path
+	}
+
+	return file.ID
+}
+
+func isSFTPNotFound(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, os.ErrNotExist)
+}
+
+// Download downloads a file from the storage provider and moves it to the temporary file store
+func (s *SFTPProvider) Download(fileCollection string, file rocketchat.File) (string, error) {
+	return downloadToTemp(s.TempFileLocation, file, func(f *os.File) error {
+		client, err := s.sftpClient()
+		if err != nil {
+			return err
+		}
+
+		remote, err := client.Open(s.remotePath(sftpFilePath(file)))
+		if err != nil {
+			if isSFTPNotFound(err) {
+				return ErrNotFound
+			}
+
+			s.reset(client)
+
+			return err
+		}
+
+		defer remote.Close()
+
+		if _, err = io.Copy(f, s.limiter.Reader(remote)); err != nil {
+			s.reset(client)
+			return err
+		}
+
+		return nil
+	})
+}
+
+// Upload uploads a file from given path to the storage provider, creating the directories of objectPath as needed
+func (s *SFTPProvider) Upload(objectPath string, filePath string, contentType string) error {
+	client, err := s.sftpClient()
+	if err != nil {
+		return err
+	}
+
+	local, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+
+	defer local.Close()
+
+	remotePath := s.remotePath(objectPath)
+
+	if err := client.MkdirAll(path.Dir(remotePath)); err != nil {
+		s.reset(client)
+		return err
+	}
+
+	remote, err := client.Create(remotePath)
+	if err != nil {
+		s.reset(client)
+		return err
+	}
+
+	defer remote.Close()
+
+	if _, err := io.Copy(remote, s.limiter.Reader(local)); err != nil {
+		s.reset(client)
+		return err
+	}
+
+	return nil
+}
+
+// Stat describes the file at objectPath below Location. Files carry no content type on the server
+func (s *SFTPProvider) Stat(objectPath string) (FileInfo, error) {
+	client, err := s.sftpClient()
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	info, err := client.Stat(s.remotePath(objectPath))
+	if err != nil {
+		if isSFTPNotFound(err) {
+			return FileInfo{}, ErrNotFound
+		}
+
+		s.reset(client)
+
+		return FileInfo{}, err
+	}
+
+	return FileInfo{Size: info.Size(), Exists: true}, nil
+}
+
+// Delete removes the file from the server, a file that is already gone is not an error
+func (s *SFTPProvider) Delete(fileCollection string, file rocketchat.File, permanentelyDelete bool) error {
+	if !permanentelyDelete {
+		return nil
+	}
+
+	client, err := s.sftpClient()
+	if err != nil {
+		return err
+	}
+
+	if err := client.Remove(s.remotePath(sftpFilePath(file))); err != nil && !isSFTPNotFound(err) {
+		s.reset(client)
+		return err
+	}
+
+	return nil
+}
+
+// List returns the paths, relative to Location, of all files starting with prefix
+func (s *SFTPProvider) List(prefix string) ([]string, error) {
+	client, err := s.sftpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := client.ReadDir(s.remotePath(dir))
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			entryPath := path.Join(dir, entry.Name())
+
+			if entry.IsDir() {
+				// Only descend into directories that can hold paths with the prefix
+				if strings.HasPrefix(entryPath+"/", prefix) || strings.HasPrefix(prefix, entryPath+"/") {
+					if err := walk(entryPath); err != nil {
+						return err
+					}
+				}
+
+				continue
+			}
+
+			if strings.HasPrefix(entryPath, prefix) {
+				paths = append(paths, entryPath)
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(""); err != nil {
+		if isSFTPNotFound(err) {
+			return nil, nil
+		}
+
+		s.reset(client)
+
+		return nil, err
+	}
+
+	return paths, nil
+}
+
+// DeleteObject removes the file at objectPath relative to Location
+func (s *SFTPProvider) DeleteObject(objectPath string) error {
+	client, err := s.sftpClient()
+	if err != nil {
+		return err
+	}
+
+	if err := client.Remove(s.remotePath(objectPath)); err != nil && !isSFTPNotFound(err) {
+		s.reset(client)
+		return err
+	}
+
+	return nil
+}
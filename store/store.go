@@ -2,6 +2,7 @@ package store
 
 import (
 	"errors"
+	"io"
 
 	"github.com/RocketChat/filestore-migrator/rocketchat"
 )
@@ -11,16 +12,62 @@ var (
 	ErrNotFound = errors.New("not found")
 )
 
+// FileInfo describes an object held by a storage provider
+type FileInfo struct {
+	Size        int64
+	ContentType string
+	Exists      bool
+}
+
 // Provider describes the basic contract provided to access a static content storage provider.
 type Provider interface {
 	// StoreType returns the name of the store
 	StoreType() string
 	// Upload uploads a file from given path to the storage provider
 	Upload(objectPath string, filePath string, contentType string) error
-	// Download downloads a file from the storage provider and moves it to the temporary file store
+	// Download downloads a file from the storage provider and moves it to the temporary file store, returning its path.
+	// ErrNotFound is returned when the file can't be located, a path is always returned along with a nil error
 	Download(fileCollection string, file rocketchat.File) (string, error)
 	// SetTempDirectory allows for the setting of the directory that will be used for temporary file store during operations
 	SetTempDirectory(subdir string)
+	// SetRateLimiter makes downloads and uploads count against limiter, nil removes the limit
+	SetRateLimiter(limiter *RateLimiter)
+	// Stat describes the object at the given path, ErrNotFound is returned when there is none
+	Stat(path string) (FileInfo, error)
+	// List returns the paths of all objects whose path starts with prefix
+	List(prefix string) ([]string, error)
+	// Delete removes the object of the file, fileCollection is the collection its document was read from like for Download
+	Delete(fileCollection string, file rocketchat.File, permanentelyDelete bool) error
+	// DeleteObject removes exactly the object at objectPath, as returned by List. A missing object is not an error
+	DeleteObject(objectPath string) error
+	// Close releases the connections held by the provider, it can still be used afterwards and connects again
+	Close() error
+}
+
+// Opener is implemented by providers that can stream a file instead of downloading it to the temporary file store
+type Opener interface {
+	// Open returns the content of the file and its size, -1 when it isn't known.
+	// ErrNotFound is returned when the file can't be located
+	Open(fileCollection string, file rocketchat.File) (io.ReadCloser, int64, error)
+}
+
+// Presigner is implemented by providers that can hand out a URL the file can be downloaded from without credentials
+type Presigner interface {
+	// PresignDownload returns a temporary GET URL for the file, ErrNotFound when the file has no object
+	PresignDownload(file rocketchat.File) (string, error)
+	// OpenPresigned streams the file from a presigned URL. The request goes through the provider's HTTP transport and
+	// counts against its rate limiter like any other download. ErrNotFound is returned when the file can't be located
+	OpenPresigned(file rocketchat.File) (io.ReadCloser, int64, error)
+}
+
+// Tagger is implemented by providers that can tag objects with the Rocket.Chat metadata of the file they hold
+type Tagger interface {
+	// TagObject tags the object at objectPath with the room, user and store name of file
+	TagObject(objectPath string, file rocketchat.File, storeName string) error
+}
 
-	Delete(file rocketchat.File, permanentelyDelete bool) error
+// ReaderUploader is implemented by providers that can upload straight from a reader
+type ReaderUploader interface {
+	// UploadReader uploads size bytes, -1 when unknown, read from reader to objectPath
+	UploadReader(objectPath string, reader io.Reader, size int64, contentType string) error
 }
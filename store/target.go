@@ -0,0 +1,53 @@
+package store
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// SameTarget tells whether a and b are the same type of provider pointed at the same place,
+// so that uploading to one overwrites what is read from the other
+func SameTarget(a Provider, b Provider) bool {
+	if a == nil || b == nil || a.StoreType() != b.StoreType() {
+		return false
+	}
+
+	switch a := a.(type) {
+	case *S3Provider:
+		b, ok := b.(*S3Provider)
+		return ok && normalizeEndpoint(a.Endpoint, "s3.amazonaws.com") == normalizeEndpoint(b.Endpoint, "s3.amazonaws.com") && a.Bucket == b.Bucket
+	case *GoogleStorageProvider:
+		b, ok := b.(*GoogleStorageProvider)
+		return ok && a.Bucket == b.Bucket
+	case *FileSystemStorageProvider:
+		b, ok := b.(*FileSystemStorageProvider)
+		return ok && filepath.Clean(a.Location) == filepath.Clean(b.Location)
+	case *GridFSProvider:
+		b, ok := b.(*GridFSProvider)
+		return ok && a.Database == b.Database && reflect.DeepEqual(a.BucketNames, b.BucketNames)
+	case *AzureBlobProvider:
+		b, ok := b.(*AzureBlobProvider)
+		return ok && a.accountName() == b.accountName() && a.Container == b.Container
+	case *WebDAVProvider:
+		b, ok := b.(*WebDAVProvider)
+		return ok && normalizeEndpoint(a.URL, "") == normalizeEndpoint(b.URL, "")
+	case *SFTPProvider:
+		b, ok := b.(*SFTPProvider)
+		return ok && a.Host == b.Host && a.port() == b.port() && filepath.Clean(a.Location) == filepath.Clean(b.Location)
+	}
+
+	return false
+}
+
+// normalizeEndpoint drops the scheme and trailing slashes, an empty endpoint is the default one
+func normalizeEndpoint(endpoint string, defaultEndpoint string) string {
+	endpoint = strings.TrimPrefix(strings.TrimPrefix(endpoint, "https://"), "http://")
+	endpoint = strings.ToLower(strings.TrimSuffix(endpoint, "/"))
+
+	if endpoint == "" {
+		return defaultEndpoint
+	}
+
+	return endpoint
+}
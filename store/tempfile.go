@@ -0,0 +1,46 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+)
+
+// TempFilePath returns where the file is kept once downloaded to the temporary file store dir
+func TempFilePath(dir string, file rocketchat.File) string {
+	return dir + "/" + file.ID
+}
+
+// downloadToTemp downloads the file with write unless it is in the temporary file store already, returning its path.
+// write gets a uniquely named partial file that is only renamed into place once complete, so concurrent downloads
+// never write to the same file and a failed download leaves nothing behind that looks downloaded
+func downloadToTemp(dir string, file rocketchat.File, write func(f *os.File) error) (string, error) {
+	filePath := TempFilePath(dir, file)
+
+	if _, err := os.Stat(filePath); err == nil {
+		return filePath, nil
+	}
+
+	partial, err := ioutil.TempFile(dir, file.ID+".*.partial")
+	if err != nil {
+		return "", err
+	}
+
+	err = write(partial)
+
+	if closeErr := partial.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(partial.Name(), filePath)
+	}
+
+	if err != nil {
+		os.Remove(partial.Name())
+		return "", err
+	}
+
+	return filePath, nil
+}
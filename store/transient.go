@@ -0,0 +1,51 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	minio "github.com/minio/minio-go/v7"
+	"google.golang.org/api/googleapi"
+)
+
+// IsTransient reports whether err is likely to go away when the operation is retried, such as timeouts, refused or reset
+// connections and 5xx or throttling responses. ErrNotFound is never transient, nor are network errors that persist
+// like an unknown host or a certificate that can't be verified
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, ErrNotFound) {
+		return false
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return isTransientStatus(googleErr.Code)
+	}
+
+	if s3Err := minio.ToErrorResponse(err); s3Err.StatusCode != 0 {
+		return isTransientStatus(s3Err.StatusCode)
+	}
+
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) {
+		return temporary.Temporary()
+	}
+
+	return false
+}
+
+func isTransientStatus(code int) bool {
+	return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+}
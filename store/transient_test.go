@@ -0,0 +1,57 @@
+package store
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	minio "github.com/minio/minio-go/v7"
+	"google.golang.org/api/googleapi"
+)
+
+// requestError wraps err the way the HTTP client returns it
+func requestError(err error) error {
+	return &url.Error{Op: "Get", URL: "https://storage.example.com/bucket/object", Err: err}
+}
+
+// dialError wraps errno the way a failed dial returns it
+func dialError(errno syscall.Errno) error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "not found", err: fmt.Errorf("download: %w", ErrNotFound), want: false},
+		{name: "unexpected EOF", err: requestError(io.ErrUnexpectedEOF), want: true},
+		{name: "connection reset", err: requestError(dialError(syscall.ECONNRESET)), want: true},
+		{name: "connection refused", err: requestError(dialError(syscall.ECONNREFUSED)), want: true},
+		{name: "timeout", err: requestError(&net.DNSError{Err: "i/o timeout", Name: "storage.example.com", IsTimeout: true}), want: true},
+		{name: "unknown host", err: requestError(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "storage.example.com", IsNotFound: true}}), want: false},
+		{name: "untrusted certificate", err: requestError(x509.UnknownAuthorityError{}), want: false},
+		{name: "certificate for another host", err: requestError(x509.HostnameError{Certificate: &x509.Certificate{}, Host: "storage.example.com"}), want: false},
+		{name: "S3 unavailable", err: minio.ErrorResponse{StatusCode: 503, Code: "SlowDown"}, want: true},
+		{name: "S3 access denied", err: minio.ErrorResponse{StatusCode: 403, Code: "AccessDenied"}, want: false},
+		{name: "Google throttled", err: &googleapi.Error{Code: 429}, want: true},
+		{name: "Google bad request", err: &googleapi.Error{Code: 400}, want: false},
+		{name: "other error", err: errors.New("invalid object path"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.want {
+				t.Errorf("IsTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,433 @@
+package store
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+)
+
+// WebDAVProvider provides methods to use a WebDAV server as a storage provider.
+// Username and Password are sent with basic auth, or digest auth when the server asks for it
+type WebDAVProvider struct {
+	URL              string
+	Username         string
+	Password         string
+	TempFileLocation string
+
+	Client *http.Client
+
+	limiter *RateLimiter
+}
+
+// StoreType returns the name of the store
+func (w *WebDAVProvider) StoreType() string {
+	return "WebDAV"
+}
+
+// SetTempDirectory allows for the setting of the directory that will be used for temporary file store during operations
+func (w *WebDAVProvider) SetTempDirectory(dir string) {
+	w.TempFileLocation = dir
+}
+
+// SetRateLimiter makes downloads and uploads count against limiter, nil removes the limit
+func (w *WebDAVProvider) SetRateLimiter(limiter *RateLimiter) {
+	w.limiter = limiter
+}
+
+func (w *WebDAVProvider) client() *http.Client {
+	if w.Client != nil {
+		return w.Client
+	}
+
+	return http.DefaultClient
+}
+
+// Close closes the idle connections of Client, the shared default client is left alone
+func (w *WebDAVProvider) Close() error {
+	if w.Client != nil {
+		w.Client.CloseIdleConnections()
+	}
+
+	return nil
+}
+
+func (w *WebDAVProvider) objectURL(objectPath string) string {
+	return strings.TrimSuffix(w.URL, "/") + "/" + strings.TrimPrefix(objectPath, "/")
+}
+
+// webDAVFilePath returns where the file lives on the server, files that never had a path are stored by ID
+func webDAVFilePath(file rocketchat.File) string {
+	if file.WebDAV.Path != "" {
+		return file.WebDAV.Path
+	}
+
+	return file.ID
+}
+
+// do sends the request, answering a digest challenge when the server responds with one.
+// body is called for every attempt so the content, of the returned length, can be sent again
+func (w *WebDAVProvider) do(method string, url string, body func() (io.Reader, int64, error), header http.Header) (*http.Response, error) {
+	newRequest := func() (*http.Request, error) {
+		var (
+			reader io.Reader
+			length int64
+		)
+
+		if body != nil {
+			var err error
+			if reader, length, err = body(); err != nil {
+				return nil, err
+			}
+		}
+
+		req, err := http.NewRequest(method, url, reader)
+		if err != nil {
+			return nil, err
+		}
+
+		req.ContentLength = length
+
+		for key, values := range header {
+			req.Header[key] = values
+		}
+
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	if w.Username != "" {
+		req.SetBasicAuth(w.Username, w.Password)
+	}
+
+	resp, err := w.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode != http.StatusUnauthorized || w.Username == "" || !strings.HasPrefix(strings.ToLower(challenge), "digest ") {
+		return resp, nil
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if req, err = newRequest(); err != nil {
+		return nil, err
+	}
+
+	authorization, err := digestAuthorization(challenge, method, req.URL.RequestURI(), w.Username, w.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", authorization)
+
+	return w.client().Do(req)
+}
+
+// digestAuthorization answers an RFC 2617 digest challenge with the MD5 algorithm
+func digestAuthorization(challenge string, method string, uri string, username string, password string) (string, error) {
+	params := make(map[string]string)
+
+	for _, part := range strings.Split(challenge[len("digest "):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+
+	if algorithm := params["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+		return "", fmt.Errorf("unsupported digest algorithm %s", algorithm)
+	}
+
+	md5Hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	ha1 := md5Hex(username + ":" + params["realm"] + ":" + password)
+	ha2 := md5Hex(method + ":" + uri)
+
+	authorization := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, username, params["realm"], params["nonce"], uri)
+
+	if qop := params["qop"]; qop != "" {
+		nonce := make([]byte, 8)
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+
+		cnonce := hex.EncodeToString(nonce)
+		response := md5Hex(ha1 + ":" + params["nonce"] + ":00000001:" + cnonce + ":auth:" + ha2)
+
+		authorization += fmt.Sprintf(`, qop=auth, nc=00000001, cnonce="%s", response="%s"`, cnonce, response)
+	} else {
+		authorization += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+params["nonce"]+":"+ha2))
+	}
+
+	if opaque := params["opaque"]; opaque != "" {
+		authorization += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+
+	return authorization + `, algorithm=MD5`, nil
+}
+
+// Download downloads a file from the storage provider and moves it to the temporary file store
+func (w *WebDAVProvider) Download(fileCollection string, file rocketchat.File) (string, error) {
+	return downloadToTemp(w.TempFileLocation, file, func(f *os.File) error {
+		resp, err := w.do(http.MethodGet, w.objectURL(webDAVFilePath(file)), nil, nil)
+		if err != nil {
+			return err
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return ErrNotFound
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unable to download %s: %s", webDAVFilePath(file), resp.Status)
+		}
+
+		_, err = io.Copy(f, w.limiter.Reader(resp.Body))
+
+		return err
+	})
+}
+
+// Upload uploads a file from given path to the storage provider, creating the collections of objectPath as needed
+func (w *WebDAVProvider) Upload(objectPath string, filePath string, contentType string) error {
+	if err := w.makeCollections(path.Dir(strings.TrimPrefix(objectPath, "/"))); err != nil {
+		return err
+	}
+
+	var file *os.File
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	body := func() (io.Reader, int64, error) {
+		if file != nil {
+			file.Close()
+		}
+
+		var err error
+		if file, err = os.Open(filePath); err != nil {
+			return nil, 0, err
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return w.limiter.Reader(file), info.Size(), nil
+	}
+
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	resp, err := w.do(http.MethodPut, w.objectURL(objectPath), body, header)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unable to upload %s: %s", objectPath, resp.Status)
+	}
+
+	return nil
+}
+
+// makeCollections creates every collection of dir that doesn't exist yet
+func (w *WebDAVProvider) makeCollections(dir string) error {
+	if dir == "." || dir == "" {
+		return nil
+	}
+
+	current := ""
+
+	for _, element := range strings.Split(dir, "/") {
+		current += element + "/"
+
+		resp, err := w.do("MKCOL", w.objectURL(current), nil, nil)
+		if err != nil {
+			return err
+		}
+
+		resp.Body.Close()
+
+		// 405 is returned for collections that already exist
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("unable to create collection %s: %s", current, resp.Status)
+		}
+	}
+
+	return nil
+}
+
+// Stat reads the size and content type of the object from a HEAD request
+func (w *WebDAVProvider) Stat(objectPath string) (FileInfo, error) {
+	resp, err := w.do(http.MethodHead, w.objectURL(objectPath), nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return FileInfo{}, ErrNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return FileInfo{}, fmt.Errorf("unable to stat %s: %s", objectPath, resp.Status)
+	}
+
+	return FileInfo{Size: resp.ContentLength, ContentType: resp.Header.Get("Content-Type"), Exists: true}, nil
+}
+
+// Delete removes the file from the server, a file that is already gone is not an error
+func (w *WebDAVProvider) Delete(fileCollection string, file rocketchat.File, permanentelyDelete bool) error {
+	if !permanentelyDelete {
+		return nil
+	}
+
+	resp, err := w.do(http.MethodDelete, w.objectURL(webDAVFilePath(file)), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unable to delete %s: %s", webDAVFilePath(file), resp.Status)
+	}
+
+	return nil
+}
+
+// webDAVMultistatus is the part of a PROPFIND response needed to tell files from collections
+type webDAVMultistatus struct {
+	Responses []struct {
+		Href       string    `xml:"href"`
+		Collection *struct{} `xml:"propstat>prop>resourcetype>collection"`
+	} `xml:"response"`
+}
+
+// List returns the paths, relative to URL, of all files starting with prefix.
+// Collections are walked one level at a time as not every server allows an infinite depth
+func (w *WebDAVProvider) List(prefix string) ([]string, error) {
+	base, err := url.Parse(w.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	basePath := strings.Trim(base.Path, "/")
+
+	var paths []string
+
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		header := http.Header{}
+		header.Set("Depth", "1")
+
+		resp, err := w.do("PROPFIND", w.objectURL(dir), nil, header)
+		if err != nil {
+			return err
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return nil
+		}
+
+		if resp.StatusCode != http.StatusMultiStatus {
+			return fmt.Errorf("unable to list %s: %s", dir, resp.Status)
+		}
+
+		var multistatus webDAVMultistatus
+		if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+			return err
+		}
+
+		for _, response := range multistatus.Responses {
+			href, err := url.Parse(response.Href)
+			if err != nil {
+				return err
+			}
+
+			entryPath := strings.Trim(href.Path, "/")
+			if basePath != "" {
+				entryPath = strings.TrimPrefix(strings.TrimPrefix(entryPath, basePath), "/")
+			}
+
+			// The collection itself is part of its own listing
+			if entryPath == strings.TrimSuffix(dir, "/") {
+				continue
+			}
+
+			if response.Collection != nil {
+				if strings.HasPrefix(entryPath+"/", prefix) || strings.HasPrefix(prefix, entryPath+"/") {
+					if err := walk(entryPath + "/"); err != nil {
+						return err
+					}
+				}
+
+				continue
+			}
+
+			if strings.HasPrefix(entryPath, prefix) {
+				paths = append(paths, entryPath)
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+}
+
+// DeleteObject removes the file at objectPath relative to URL
+func (w *WebDAVProvider) DeleteObject(objectPath string) error {
+	resp, err := w.do(http.MethodDelete, w.objectURL(objectPath), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unable to delete %s: %s", objectPath, resp.Status)
+	}
+
+	return nil
+}
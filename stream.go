@@ -0,0 +1,154 @@
+package migrator
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"github.com/RocketChat/filestore-migrator/store"
+)
+
+// SetPresignedDownloads makes migrations from sources that can presign URLs, ie. S3, read the files from presigned URLs
+// with the source store's HTTP transport instead of through its client, streaming them to destinations that can upload from a reader
+func (m *Migrate) SetPresignedDownloads(presigned bool) {
+	m.presignedDownloads = presigned
+}
+
+// canStream reports whether files can go from the source straight to the destination store, without a temp file
+func (m *Migrate) canStream() bool {
+	if _, ok := m.destinationStore.(store.ReaderUploader); !ok {
+		return false
+	}
+
+	if _, ok := m.sourceStore.(store.Presigner); ok && m.presignedDownloads {
+		return true
+	}
+
+	_, ok := m.sourceStore.(store.Opener)
+
+	return ok
+}
+
+// openSource opens the file in the source store, from a presigned URL when enabled
+func (m *Migrate) openSource(file rocketchat.File) (io.ReadCloser, int64, error) {
+	if presigner, ok := m.sourceStore.(store.Presigner); ok && m.presignedDownloads {
+		return presigner.OpenPresigned(file)
+	}
+
+	return m.sourceStore.(store.Opener).Open(m.fileCollectionName, file)
+}
+
+// streamFile copies a single file from the source to the destination store as it is read.
+// A failed upload can't rewind the stream, so every retry opens the file again.
+// skipped is true when the file isn't in the source store and its document must be left alone
+func (m *Migrate) streamFile(ctx context.Context, index int, total int, file *rocketchat.File, objectPath string) (skipped bool, err error) {
+	uploader := m.destinationStore.(store.ReaderUploader)
+
+	var (
+		reader io.ReadCloser
+		size   int64
+	)
+
+	defer func() {
+		if reader != nil {
+			reader.Close()
+		}
+	}()
+
+	open := func() (err error) {
+		if reader != nil {
+			reader.Close()
+			reader = nil
+		}
+
+		reader, size, err = m.openSource(*file)
+
+		return err
+	}
+
+	m.progress(*file, index, total, PhaseDownloading, nil)
+
+	if err := m.withRetry(ctx, "Download of "+file.Name, open); err != nil {
+		if m.skipFailedDownload(*file, index, total, err) {
+			return true, nil
+		}
+
+		m.progress(*file, index, total, PhaseDownloading, err)
+
+		return false, err
+	}
+
+	m.debugf("[%v/%v] Streaming to %s to: %s", index, total, m.destinationStore.StoreType(), objectPath)
+	m.progress(*file, index, total, PhaseUploading, nil)
+
+	var uploaded int64
+
+	first := true
+
+	err = m.withRetry(ctx, "Upload of "+file.Name, func() error {
+		if !first {
+			if err := open(); err != nil {
+				return err
+			}
+		}
+
+		first = false
+
+		buffered := bufio.NewReader(reader)
+		m.sniffStreamContentType(file, buffered)
+
+		counter := &countingReader{r: buffered}
+
+		err := uploader.UploadReader(objectPath, counter, size, file.Type)
+		uploaded = counter.n
+
+		return err
+	})
+	if err != nil {
+		m.progress(*file, index, total, PhaseUploading, err)
+		return false, err
+	}
+
+	m.addBytes(uploaded, uploaded)
+
+	if m.verifyChecksum {
+		if err := m.verifyObject(objectPath, uploaded, *file); err != nil {
+			m.progress(*file, index, total, PhaseUploading, err)
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// sniffStreamContentType fills in a missing type like sniffContentType, from the start of the stream
+func (m *Migrate) sniffStreamContentType(file *rocketchat.File, reader *bufio.Reader) {
+	if file.Type != "" {
+		return
+	}
+
+	head, err := reader.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		m.debugf("unable to sniff the type of %s: %v", file.Name, err)
+		return
+	}
+
+	file.Type = http.DetectContentType(head)
+
+	m.debugf("%s has no type, detected %s", file.Name, file.Type)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
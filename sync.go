@@ -0,0 +1,28 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+)
+
+// SyncNew migrates the files uploaded since the last sync, for keeping the destination up to date while Rocket.Chat
+// still writes to the source. It needs an offset store, see SetOffsetStore, and leaves out files already in the
+// destination store. Files still being uploaded hold the stored offset back, so they are picked up once complete.
+// It is safe to run on a schedule, an offset set with SetFileOffset takes precedence over the stored one
+func (m *Migrate) SyncNew() (*MigrationResult, error) {
+	return m.SyncNewContext(context.Background())
+}
+
+// SyncNewContext migrates the files uploaded since the last sync like SyncNew
+func (m *Migrate) SyncNewContext(ctx context.Context) (*MigrationResult, error) {
+	if m.offsetStoreFile == "" {
+		return nil, errors.New("For SyncNew must have an offset store set")
+	}
+
+	previousSkipMigrated := m.skipMigrated
+	m.skipMigrated = true
+
+	defer func() { m.skipMigrated = previousSkipMigrated }()
+
+	return m.MigrateStoreResultContext(ctx)
+}
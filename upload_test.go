@@ -0,0 +1,54 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"github.com/RocketChat/filestore-migrator/store"
+)
+
+func TestUploadAllWithoutDatabaseUpdate(t *testing.T) {
+	destination := &store.FileSystemStorageProvider{Location: t.TempDir(), Compress: true}
+
+	// Nothing listens on the address, the run fails once it reaches the database
+	m := &Migrate{
+		connectionString:     "mongodb://127.0.0.1:1/rocketchat?serverSelectionTimeoutMS=100&connectTimeoutMS=100",
+		databaseName:         "rocketchat",
+		storeName:            "Uploads",
+		sourceStore:          &store.GridFSProvider{},
+		destinationStore:     destination,
+		databaseRetryTimeout: time.Millisecond,
+	}
+	defer m.Close()
+
+	if _, err := m.UploadAllResultContext(context.Background(), t.TempDir()); !errors.Is(err, ErrCompressedDestination) {
+		t.Errorf("UploadAllResultContext() error = %v, want ErrCompressedDestination", err)
+	}
+
+	m.SetUpdateDatabase(false)
+
+	if _, err := m.UploadAllResultContext(context.Background(), t.TempDir()); errors.Is(err, ErrCompressedDestination) {
+		t.Error("UploadAllResultContext() refused a compressed destination while only copying the files")
+	}
+
+	filesRoot := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(filesRoot, "file-id"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a database session, an update of the document would fail
+	file := rocketchat.File{ID: "file-id", Name: "notes.txt", Type: "text/plain", Complete: true, Store: "FileSystem:Uploads"}
+
+	if err := m.uploadLocalFile(context.Background(), filesRoot, 1, 1, file); err != nil {
+		t.Fatalf("uploadLocalFile() error = %v", err)
+	}
+
+	if info, err := destination.Stat("file-id"); err != nil || info.Size != int64(len("content")) {
+		t.Errorf("Stat() of the uploaded file = %+v, %v", info, err)
+	}
+}
@@ -0,0 +1,177 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"github.com/RocketChat/filestore-migrator/store"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrVerificationFailed is returned when an uploaded object doesn't match the file that was migrated
+var ErrVerificationFailed = errors.New("verification failed")
+
+// VerifyReport lists the files whose objects are missing or have the wrong size in the destination store
+type VerifyReport struct {
+	Total      int
+	Verified   int
+	Missing    []string
+	Mismatched []string
+
+	mu sync.Mutex
+}
+
+// SetVerifyChecksum enables checking every uploaded object against the local copy and the file document before the document is updated
+func (m *Migrate) SetVerifyChecksum(verify bool) {
+	m.verifyChecksum = verify
+}
+
+// verifyUpload compares the size of the local copy with the file document and with the object now in the destination store
+func (m *Migrate) verifyUpload(objectPath string, localPath string, file rocketchat.File) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+
+	return m.verifyObject(objectPath, info.Size(), file)
+}
+
+// verifyObject compares size, the bytes that were uploaded, with the file document and with the object in the destination store
+func (m *Migrate) verifyObject(objectPath string, size int64, file rocketchat.File) error {
+	if file.Size > 0 && size != int64(file.Size) {
+		return fmt.Errorf("%w: %s has %d bytes locally, expected %d", ErrVerificationFailed, file.ID, size, file.Size)
+	}
+
+	stored, err := m.destinationStore.Stat(objectPath)
+	if errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("%w: %s not found in %s at %s", ErrVerificationFailed, file.ID, m.destinationStore.StoreType(), objectPath)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if stored.Size != size {
+		return fmt.Errorf("%w: %s has %d bytes in %s, expected %d", ErrVerificationFailed, file.ID, stored.Size, m.destinationStore.StoreType(), size)
+	}
+
+	return nil
+}
+
+// VerifyStore checks that every file of the store pointing at the destination store has its object present there with the expected size.
+// Nothing is copied or updated
+func (m *Migrate) VerifyStore() (*VerifyReport, error) {
+	return m.VerifyStoreContext(context.Background())
+}
+
+// VerifyStoreContext checks the destination store like VerifyStore.
+// Cancelling ctx stops the run once the files in flight are checked
+func (m *Migrate) VerifyStoreContext(ctx context.Context) (*VerifyReport, error) {
+	if m.destinationStore == nil {
+		return nil, errors.New("For VerifyStore must have a destination store provided")
+	}
+
+	files, err := m.findFiles(ctx, m.verifyQuery())
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{Total: len(files)}
+
+	err = m.forEachFile(ctx, files, func(ctx context.Context, index int, total int, file rocketchat.File) error {
+		if !file.Complete {
+			return nil
+		}
+
+		objectPath, err := m.verifyObjectPath(file)
+		if err != nil {
+			return err
+		}
+
+		var stored store.FileInfo
+
+		if err := m.withRetry(ctx, "Verify of "+file.Name, func() (err error) {
+			stored, err = m.destinationStore.Stat(objectPath)
+			return err
+		}); err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+
+		report.mu.Lock()
+		defer report.mu.Unlock()
+
+		switch {
+		case !stored.Exists:
+			m.debugf("[%v/%v] %s missing from %s at %s", index, total, file.ID, m.destinationStore.StoreType(), objectPath)
+			report.Missing = append(report.Missing, file.ID)
+		case file.Size > 0 && stored.Size != int64(file.Size):
+			m.debugf("[%v/%v] %s has %d bytes in %s, expected %d", index, total, file.ID, stored.Size, m.destinationStore.StoreType(), file.Size)
+			report.Mismatched = append(report.Mismatched, file.ID)
+		default:
+			report.Verified++
+		}
+
+		return nil
+	})
+
+	m.infof("Verified %d of %d files, %d missing, %d mismatched", report.Verified, report.Total, len(report.Missing), len(report.Mismatched))
+
+	return report, err
+}
+
+// verifyQuery finds the files pointing at the destination store. It doesn't depend on a source store,
+// so a store can be verified on its own
+func (m *Migrate) verifyQuery() bson.M {
+	query := bson.M{"store": m.destinationStore.StoreType() + ":" + m.storeName}
+
+	m.addFileFilters(query)
+
+	return query
+}
+
+// verifyObjectPath returns the path the document records for its object in the destination store. Files found by ID,
+// ie. in FileSystem and GridFS, record none and get the path they are migrated to
+func (m *Migrate) verifyObjectPath(file rocketchat.File) (string, error) {
+	if referencePath := storeReferencePath(m.destinationStore.StoreType(), file); referencePath != "" {
+		return referencePath, nil
+	}
+
+	m.fillFileDefaults(&file)
+
+	return m.getObjectPath(&file)
+}
+
+// SetSkipIfDestinationExists makes MigrateStore leave files alone that are already in the destination store with the
+// expected size, only their documents are updated. Objects with a different size are uploaded again
+func (m *Migrate) SetSkipIfDestinationExists(skip bool) {
+	m.skipIfDestinationExists = skip
+}
+
+// destinationHasFile reports whether the object at objectPath has the size of file. Failing to tell is treated as not
+// having it, so the file is uploaded again
+func (m *Migrate) destinationHasFile(ctx context.Context, objectPath string, file rocketchat.File) bool {
+	var stored store.FileInfo
+
+	err := m.withRetry(ctx, "Stat of "+file.Name, func() (err error) {
+		stored, err = m.destinationStore.Stat(objectPath)
+		return err
+	})
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			m.debugf("unable to check %s in %s: %v", objectPath, m.destinationStore.StoreType(), err)
+		}
+
+		return false
+	}
+
+	if stored.Size != int64(file.Size) {
+		m.debugf("%s has %d bytes in %s, expected %d, uploading it again", objectPath, stored.Size, m.destinationStore.StoreType(), file.Size)
+		return false
+	}
+
+	return true
+}
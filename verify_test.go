@@ -0,0 +1,73 @@
+package migrator
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+	"github.com/RocketChat/filestore-migrator/store"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestVerifyStoreWithoutSourceStore(t *testing.T) {
+	// Nothing listens on the address, the run has to get as far as the database without touching a source store
+	m := &Migrate{
+		connectionString:     "mongodb://127.0.0.1:1/rocketchat?serverSelectionTimeoutMS=100&connectTimeoutMS=100",
+		databaseName:         "rocketchat",
+		storeName:            "Uploads",
+		destinationStore:     &store.S3Provider{},
+		databaseRetryTimeout: time.Millisecond,
+	}
+	defer m.Close()
+
+	if _, err := m.VerifyStoreContext(context.Background()); err == nil {
+		t.Error("VerifyStoreContext() without a database didn't fail")
+	}
+}
+
+func TestVerifyQuery(t *testing.T) {
+	offset := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	m := &Migrate{storeName: "Uploads", destinationStore: &store.S3Provider{}, fileOffset: offset, maxSize: 1024}
+
+	want := bson.M{
+		"store":      "AmazonS3:Uploads",
+		"uploadedAt": bson.M{"$gte": offset},
+		"size":       bson.M{"$lte": int64(1024)},
+	}
+
+	if got := m.verifyQuery(); !reflect.DeepEqual(got, want) {
+		t.Errorf("verifyQuery() = %v, want %v", got, want)
+	}
+}
+
+func TestVerifyObjectPath(t *testing.T) {
+	m := &Migrate{storeName: "Uploads", uniqueID: "unique-id", destinationPrefix: "current-prefix", destinationStore: &store.S3Provider{}}
+
+	// Migrated under an older prefix, the document is what tells where the object is
+	file := rocketchat.File{ID: "file-id", Rid: "room-id", UserID: "user-id", Store: "AmazonS3:Uploads"}
+	file.AmazonS3.Path = "old-prefix/unique-id/uploads/room-id/user-id/file-id"
+
+	objectPath, err := m.verifyObjectPath(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if objectPath != file.AmazonS3.Path {
+		t.Errorf("verifyObjectPath() = %q, want the recorded %q", objectPath, file.AmazonS3.Path)
+	}
+
+	// FileSystem documents record no path, the object is found by ID
+	m.destinationStore = &store.FileSystemStorageProvider{}
+
+	objectPath, err = m.verifyObjectPath(rocketchat.File{ID: "file-id", Store: "FileSystem:Uploads"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if objectPath != "file-id" {
+		t.Errorf("verifyObjectPath() = %q, want file-id", objectPath)
+	}
+}
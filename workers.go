@@ -0,0 +1,305 @@
+package migrator
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/RocketChat/filestore-migrator/rocketchat"
+)
+
+// fileHandler processes a single file, index is 1 based and only used for logs
+type fileHandler func(ctx context.Context, index int, total int, file rocketchat.File) error
+
+// fileSource hands out the files of a run one at a time, ok is false once there are no more
+type fileSource func(ctx context.Context) (file rocketchat.File, ok bool, err error)
+
+// sliceSource hands out files in order
+func sliceSource(files []rocketchat.File) fileSource {
+	next := 0
+
+	return func(ctx context.Context) (rocketchat.File, bool, error) {
+		if next == len(files) {
+			return rocketchat.File{}, false, nil
+		}
+
+		next++
+
+		return files[next-1], true, nil
+	}
+}
+
+// fileJob is a file scheduled on a worker along with its 1 based index
+type fileJob struct {
+	index int
+	file  rocketchat.File
+}
+
+// stagedFile is a file between the download and the upload stage of a staged run, path is where it was downloaded to
+type stagedFile struct {
+	index      int
+	file       rocketchat.File
+	objectPath string
+	path       string
+}
+
+// stageDownload is the first stage of a staged run, ok is false when the file doesn't go on to the upload stage
+type stageDownload func(ctx context.Context, index int, total int, file rocketchat.File) (staged stagedFile, ok bool, err error)
+
+// stageUpload is the second stage of a staged run
+type stageUpload func(ctx context.Context, total int, staged stagedFile) error
+
+// concurrency returns how many files are processed at the same time.
+// SetMaxConcurrency takes precedence, then MAX_CONCURRENCY, defaulting to 1
+func (m *Migrate) concurrency() int {
+	if m.maxConcurrency > 0 {
+		return m.maxConcurrency
+	}
+
+	if value, ok := os.LookupEnv("MAX_CONCURRENCY"); ok {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
+
+		m.debugf("invalid MAX_CONCURRENCY value, falling back to 1")
+	}
+
+	return 1
+}
+
+// stagedConcurrency tells whether downloads and uploads run on their own workers
+func (m *Migrate) stagedConcurrency() bool {
+	return m.downloadConcurrency > 0 || m.uploadConcurrency > 0
+}
+
+// downloadWorkers returns how many files are downloaded at the same time in a staged run
+func (m *Migrate) downloadWorkers() int {
+	if m.downloadConcurrency > 0 {
+		return m.downloadConcurrency
+	}
+
+	return m.concurrency()
+}
+
+// uploadWorkers returns how many files are uploaded at the same time in a staged run
+func (m *Migrate) uploadWorkers() int {
+	if m.uploadConcurrency > 0 {
+		return m.uploadConcurrency
+	}
+
+	return m.concurrency()
+}
+
+// forEachFile runs handler for all files on a fixed pool of workers.
+// The first error stops any further files from being scheduled and is returned once the in-flight files are done.
+// In ErrorModeCollect failed files don't stop the run, their errors are returned together at the end.
+// Cancelling ctx or calling Shutdown stops the scheduling as well, files in flight get the grace period to finish
+func (m *Migrate) forEachFile(ctx context.Context, files []rocketchat.File, handler fileHandler) error {
+	return m.forEachFileFrom(ctx, sliceSource(files), len(files), handler)
+}
+
+// forEachFileFrom runs handler like forEachFile for the files handed out by next, total is only used for logs.
+// An error of next stops the run like a failed file
+func (m *Migrate) forEachFileFrom(ctx context.Context, next fileSource, total int, handler fileHandler) error {
+	scheduleCtx, workCtx, stop, done := m.startRun(ctx)
+	defer done()
+
+	atomic.StoreInt64(&m.completed, 0)
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		failed   MultiError
+	)
+
+	jobs := make(chan fileJob)
+
+	for w := 0; w < m.concurrency(); w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for job := range jobs {
+				if err := handler(workCtx, job.index, total, job.file); err != nil {
+					if m.errorMode == ErrorModeCollect && workCtx.Err() == nil {
+						failed.add(job.file.ID, err)
+						continue
+					}
+
+					errOnce.Do(func() {
+						firstErr = err
+						stop()
+					})
+
+					return
+				}
+			}
+		}()
+	}
+
+schedule:
+	for index := 1; ; index++ {
+		file, ok, err := next(scheduleCtx)
+		if err != nil {
+			if scheduleCtx.Err() == nil {
+				errOnce.Do(func() {
+					firstErr = err
+					stop()
+				})
+			}
+
+			break
+		}
+
+		if !ok {
+			break
+		}
+
+		if m.offsets != nil {
+			m.offsets.track(index, file)
+		}
+
+		select {
+		case jobs <- fileJob{index: index, file: file}:
+		case <-scheduleCtx.Done():
+			break schedule
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if err := m.stoppedErr(ctx, scheduleCtx); err != nil {
+		return err
+	}
+
+	return failed.errOrNil()
+}
+
+// forEachFileStaged runs download for the files handed out by next on the download workers and upload for the files
+// they return on the upload workers. The two are connected by a queue holding as many files as there are upload workers,
+// downloads wait while it is full. Errors stop the run like in forEachFileFrom, files already downloaded are still
+// uploaded as they are in flight
+func (m *Migrate) forEachFileStaged(ctx context.Context, next fileSource, total int, download stageDownload, upload stageUpload) error {
+	scheduleCtx, workCtx, stop, done := m.startRun(ctx)
+	defer done()
+
+	atomic.StoreInt64(&m.completed, 0)
+
+	var (
+		downloads sync.WaitGroup
+		uploads   sync.WaitGroup
+		errOnce   sync.Once
+		firstErr  error
+		failed    MultiError
+	)
+
+	// fail records the error of a file, the worker carries on with the next file when true is returned
+	fail := func(fileID string, err error) bool {
+		if m.errorMode == ErrorModeCollect && workCtx.Err() == nil {
+			failed.add(fileID, err)
+			return true
+		}
+
+		errOnce.Do(func() {
+			firstErr = err
+			stop()
+		})
+
+		return false
+	}
+
+	jobs := make(chan fileJob)
+	queue := make(chan stagedFile, m.uploadWorkers())
+
+	// Upload workers drain the queue until it is closed, so downloads never wait on a queue nobody reads
+	for w := 0; w < m.uploadWorkers(); w++ {
+		uploads.Add(1)
+
+		go func() {
+			defer uploads.Done()
+
+			for staged := range queue {
+				if err := upload(workCtx, total, staged); err != nil {
+					fail(staged.file.ID, err)
+				}
+			}
+		}()
+	}
+
+	for w := 0; w < m.downloadWorkers(); w++ {
+		downloads.Add(1)
+
+		go func() {
+			defer downloads.Done()
+
+			for job := range jobs {
+				staged, ok, err := download(workCtx, job.index, total, job.file)
+				if err != nil {
+					if fail(job.file.ID, err) {
+						continue
+					}
+
+					return
+				}
+
+				if ok {
+					queue <- staged
+				}
+			}
+		}()
+	}
+
+schedule:
+	for index := 1; ; index++ {
+		file, ok, err := next(scheduleCtx)
+		if err != nil {
+			if scheduleCtx.Err() == nil {
+				errOnce.Do(func() {
+					firstErr = err
+					stop()
+				})
+			}
+
+			break
+		}
+
+		if !ok {
+			break
+		}
+
+		if m.offsets != nil {
+			m.offsets.track(index, file)
+		}
+
+		select {
+		case jobs <- fileJob{index: index, file: file}:
+		case <-scheduleCtx.Done():
+			break schedule
+		}
+	}
+
+	close(jobs)
+	downloads.Wait()
+
+	close(queue)
+	uploads.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if err := m.stoppedErr(ctx, scheduleCtx); err != nil {
+		return err
+	}
+
+	return failed.errOrNil()
+}